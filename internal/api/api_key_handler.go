@@ -0,0 +1,258 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/kevin120202/library-management-system/internal/middleware"
+	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/tokens"
+	"github.com/kevin120202/library-management-system/internal/utils"
+)
+
+type createAPIKeyRequest struct {
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	AllowedIPs []string   `json:"allowed_ips"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+type updateAPIKeyRequest struct {
+	Name       *string    `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	AllowedIPs []string   `json:"allowed_ips"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+type APIKeyHandler struct {
+	apiKeyStore store.APIKeyStore
+	logger      *slog.Logger
+}
+
+func NewAPIKeyHandler(apiKeyStore store.APIKeyStore, logger *slog.Logger) *APIKeyHandler {
+	return &APIKeyHandler{
+		apiKeyStore: apiKeyStore,
+		logger:      logger,
+	}
+}
+
+// validateAPIKey checks a key about to be saved. A user can only hand a key
+// the general API scopes or permissions their own role already has.
+func validateAPIKey(key *store.APIKey, user *store.User) error {
+	key.Name = strings.TrimSpace(key.Name)
+	if key.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(key.Name) > 100 {
+		return errors.New("name cannot be greater than 100 characters")
+	}
+
+	if len(key.Scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, scope := range key.Scopes {
+		if _, ok := store.APIKeyScopes[scope]; !ok && !user.HasPermission(scope) {
+			return fmt.Errorf("unknown or unavailable scope %q", scope)
+		}
+	}
+
+	for _, entry := range key.AllowedIPs {
+		_, prefixErr := netip.ParsePrefix(entry)
+		_, addrErr := netip.ParseAddr(entry)
+		if prefixErr != nil && addrErr != nil {
+			return fmt.Errorf("invalid address or CIDR range %q", entry)
+		}
+	}
+
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(time.Now()) {
+		return errors.New("expires_at must be in the future")
+	}
+
+	return nil
+}
+
+func (h *APIKeyHandler) loadAPIKey(w http.ResponseWriter, r *http.Request) *store.APIKey {
+	id, err := utils.ReadIDParam(r)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid API key id"})
+		return nil
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	key, err := h.apiKeyStore.GetAPIKey(currentUser.ID, id)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getAPIKey", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil
+	}
+
+	if key == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "API key not found"})
+		return nil
+	}
+
+	return key
+}
+
+// @desc    List the current user's API keys
+// @route   GET /api/users/me/api-keys
+// @access  Private
+func (h *APIKeyHandler) HandleGetMyAPIKeys(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	keys, err := h.apiKeyStore.GetAPIKeysForUser(currentUser.ID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getAPIKeysForUser", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"api_keys": keys, "available_scopes": store.APIKeyScopes})
+}
+
+// @desc    Create an API key; the key itself is only shown in this response
+// @route   POST /api/users/me/api-keys
+// @access  Private
+func (h *APIKeyHandler) HandleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req createAPIKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingCreateAPIKey", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	key := &store.APIKey{
+		UserID:     currentUser.ID,
+		Name:       req.Name,
+		Scopes:     req.Scopes,
+		AllowedIPs: req.AllowedIPs,
+		ExpiresAt:  req.ExpiresAt,
+	}
+	if key.AllowedIPs == nil {
+		key.AllowedIPs = []string{}
+	}
+
+	err = validateAPIKey(key, currentUser)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	var ttl time.Duration
+	if key.ExpiresAt != nil {
+		ttl = time.Until(*key.ExpiresAt)
+	}
+
+	token, err := tokens.GenerateAPIKey(currentUser.ID, ttl)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "generateAPIKey", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.apiKeyStore.CreateAPIKey(key, token)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "createAPIKey", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"api_key": key, "key": token.Plaintext})
+}
+
+// @desc    Get one of the current user's API keys
+// @route   GET /api/users/me/api-keys/{id}
+// @access  Private
+func (h *APIKeyHandler) HandleGetAPIKey(w http.ResponseWriter, r *http.Request) {
+	key := h.loadAPIKey(w, r)
+	if key == nil {
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"api_key": key})
+}
+
+// @desc    Update an API key's name, scopes, address list or expiry
+// @route   PATCH /api/users/me/api-keys/{id}
+// @access  Private
+func (h *APIKeyHandler) HandleUpdateAPIKey(w http.ResponseWriter, r *http.Request) {
+	key := h.loadAPIKey(w, r)
+	if key == nil {
+		return
+	}
+
+	var req updateAPIKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingUpdateAPIKey", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Name != nil {
+		key.Name = *req.Name
+	}
+	if req.Scopes != nil {
+		key.Scopes = req.Scopes
+	}
+	if req.AllowedIPs != nil {
+		key.AllowedIPs = req.AllowedIPs
+	}
+	if req.ExpiresAt != nil {
+		key.ExpiresAt = req.ExpiresAt
+	}
+
+	err = validateAPIKey(key, middleware.GetUser(r))
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	err = h.apiKeyStore.UpdateAPIKey(key)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "updateAPIKey", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"api_key": key})
+}
+
+// @desc    Revoke an API key
+// @route   DELETE /api/users/me/api-keys/{id}
+// @access  Private
+func (h *APIKeyHandler) HandleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := utils.ReadIDParam(r)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid API key id"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	deleted, err := h.apiKeyStore.DeleteAPIKey(currentUser.ID, id)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "deleteAPIKey", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !deleted {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "API key not found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
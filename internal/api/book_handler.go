@@ -3,23 +3,35 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/kevin120202/library-management-system/internal/metrics"
 	"github.com/kevin120202/library-management-system/internal/middleware"
 	"github.com/kevin120202/library-management-system/internal/store"
 	"github.com/kevin120202/library-management-system/internal/utils"
 )
 
 type BookHandler struct {
-	BookStore store.BookStore
-	Logger    *log.Logger
+	BookStore      store.BookStore
+	FineStore      store.FineStore
+	Logger         *slog.Logger
+	LoanPeriod     time.Duration
+	MaxFineBalance int
+	Metrics        *metrics.Metrics
 }
 
-func NewBookHandler(bookStore store.BookStore, logger *log.Logger) *BookHandler {
+func NewBookHandler(bookStore store.BookStore, fineStore store.FineStore, logger *slog.Logger, loanPeriod time.Duration, maxFineBalance int, metrics *metrics.Metrics) *BookHandler {
 	return &BookHandler{
-		BookStore: bookStore,
-		Logger:    logger,
+		BookStore:      bookStore,
+		FineStore:      fineStore,
+		Logger:         logger,
+		LoanPeriod:     loanPeriod,
+		MaxFineBalance: maxFineBalance,
+		Metrics:        metrics,
 	}
 }
 
@@ -29,62 +41,125 @@ func NewBookHandler(bookStore store.BookStore, logger *log.Logger) *BookHandler
 func (bh *BookHandler) HandleGetBookByID(w http.ResponseWriter, r *http.Request) {
 	bookID, err := utils.ReadIDParam(r)
 	if err != nil {
-		bh.Logger.Printf("ERROR: readIDParam: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid workout id"})
+		bh.Logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid book id"})
 		return
 	}
 
 	book, err := bh.BookStore.GetBookByID(bookID)
 	if err != nil {
-		bh.Logger.Printf("ERROR: getBookByID: %v", err)
+		bh.Logger.ErrorContext(r.Context(), "getBookByID", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
+	if book == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "book not found"})
+		return
+	}
+
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"book": book})
 }
 
 // @desc    Get books
-// @route   Get /api/books
+// @route   Get /api/books?limit=&cursor=&sort=&order=&author=&available=
 // @access  Public
 func (bh *BookHandler) HandleGetBooks(w http.ResponseWriter, r *http.Request) {
-	books, err := bh.BookStore.GetBooks()
+	listParams, err := readListParams(r, []string{"title", "author", "created_at"}, "title")
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	params := store.BookListParams{
+		ListParams: listParams,
+		Author:     strings.TrimSpace(r.URL.Query().Get("author")),
+	}
+
+	if available := r.URL.Query().Get("available"); available != "" {
+		value, err := strconv.ParseBool(available)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "available must be true or false"})
+			return
+		}
+		params.Available = &value
+	}
+
+	page, err := bh.BookStore.GetBooks(params)
+	if err != nil {
+		bh.Logger.ErrorContext(r.Context(), "getBooks", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, pageEnvelope("books", page))
+}
+
+// @desc    Search the catalogue
+// @route   GET /api/books/search?q=&author=&available=&limit=
+// @access  Public
+func (bh *BookHandler) HandleSearchBooks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	params := store.BookSearchParams{
+		Query:  strings.TrimSpace(query.Get("q")),
+		Author: strings.TrimSpace(query.Get("author")),
+		Limit:  20,
+	}
+
+	if params.Query == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "q is required"})
+		return
+	}
+
+	if available := query.Get("available"); available != "" {
+		value, err := strconv.ParseBool(available)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "available must be true or false"})
+			return
+		}
+		params.Available = &value
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > 100 {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "limit must be between 1 and 100"})
+			return
+		}
+		params.Limit = value
+	}
+
+	results, err := bh.BookStore.SearchBooks(params)
 	if err != nil {
-		bh.Logger.Printf("ERROR: getBooks: %v", err)
+		bh.Logger.ErrorContext(r.Context(), "searchBooks", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"books": books})
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"results": results})
 }
 
 // @desc    Create a book
 // @route   POST /api/books
-// @access  Admin
+// @access  Private (books:write)
 func (bh *BookHandler) HandleCreateBook(w http.ResponseWriter, r *http.Request) {
 	var book store.Book
 
 	err := json.NewDecoder(r.Body).Decode(&book)
 	if err != nil {
-		bh.Logger.Printf("ERROR: decodingCreateBook: %v", err)
+		bh.Logger.ErrorContext(r.Context(), "decodingCreateBook", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request sent"})
 		return
 	}
 
-	currentUser := middleware.GetUser(r)
-	if currentUser == nil || currentUser == store.AnonymousUser {
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
-		return
-	}
-
-	if currentUser.AccountType != "admin" {
-		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you are not authorized to create a book"})
-		return
+	if book.Category == "" {
+		book.Category = "general"
 	}
 
 	createdBook, err := bh.BookStore.CreateBook(&book)
 	if err != nil {
-		bh.Logger.Printf("ERROR: createBook: %v", err)
+		bh.Logger.ErrorContext(r.Context(), "createBook", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create book"})
 		return
 	}
@@ -94,37 +169,38 @@ func (bh *BookHandler) HandleCreateBook(w http.ResponseWriter, r *http.Request)
 
 // @desc    Update a book
 // @route   PUT /api/books/{id}
-// @access  Admin
+// @access  Private (books:write)
 func (bh *BookHandler) HandleUpdateBookByID(w http.ResponseWriter, r *http.Request) {
 	bookID, err := utils.ReadIDParam(r)
 	if err != nil {
-		bh.Logger.Printf("ERROR: readIDParam: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid workout id"})
+		bh.Logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid book id"})
 		return
 	}
 
 	existingBook, err := bh.BookStore.GetBookByID(bookID)
 	if err != nil {
-		bh.Logger.Printf("ERROR: getBookByID: %v", err)
+		bh.Logger.ErrorContext(r.Context(), "getBookByID", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
 	if existingBook == nil {
-		http.NotFound(w, r)
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "book not found"})
 		return
 	}
 
 	var updatedBookRequest struct {
-		Title   *string `json:"title"`
-		Author  *string `json:"author"`
-		Summary *string `json:"summary"`
+		Title    *string `json:"title"`
+		Author   *string `json:"author"`
+		Summary  *string `json:"summary"`
+		Category *string `json:"category"`
 	}
 
 	err = json.NewDecoder(r.Body).Decode(&updatedBookRequest)
 	if err != nil {
-		bh.Logger.Printf("ERROR: decodingUpdateRequest: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request paylaod"})
+		bh.Logger.ErrorContext(r.Context(), "decodingUpdateRequest", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
 		return
 	}
 
@@ -137,21 +213,13 @@ func (bh *BookHandler) HandleUpdateBookByID(w http.ResponseWriter, r *http.Reque
 	if updatedBookRequest.Summary != nil {
 		existingBook.Summary = *updatedBookRequest.Summary
 	}
-
-	currentUser := middleware.GetUser(r)
-	if currentUser == nil || currentUser == store.AnonymousUser {
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
-		return
-	}
-
-	if currentUser.AccountType != "admin" {
-		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you are not authorized to create a book"})
-		return
+	if updatedBookRequest.Category != nil && *updatedBookRequest.Category != "" {
+		existingBook.Category = *updatedBookRequest.Category
 	}
 
 	err = bh.BookStore.UpdateBook(existingBook)
 	if err != nil {
-		bh.Logger.Printf("ERROR: updatingBook: %v", err)
+		bh.Logger.ErrorContext(r.Context(), "updatingBook", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
@@ -161,48 +229,43 @@ func (bh *BookHandler) HandleUpdateBookByID(w http.ResponseWriter, r *http.Reque
 
 // @desc    Delete a book
 // @route   DELETE /api/books/{id}
-// @access  Admin
+// @access  Private (books:write)
 func (bh *BookHandler) HandleDeleteBookByID(w http.ResponseWriter, r *http.Request) {
 	bookID, err := utils.ReadIDParam(r)
 	if err != nil {
-		bh.Logger.Printf("ERROR: readIDParam: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid workout id"})
-		return
-	}
-
-	currentUser := middleware.GetUser(r)
-	if currentUser == nil || currentUser == store.AnonymousUser {
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+		bh.Logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid book id"})
 		return
 	}
 
-	if currentUser.AccountType != "admin" {
-		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you are not authorized to create a book"})
+	err = bh.BookStore.DeleteBook(bookID)
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "book not found"})
 		return
 	}
 
-	err = bh.BookStore.DeleteBook(bookID)
-	if err == sql.ErrNoRows {
-		http.Error(w, "workout not found", http.StatusNotFound)
+	if err == store.ErrBookHasLoans {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "book has loan history; withdraw its items instead"})
 		return
 	}
 
 	if err != nil {
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "error deleting workout"})
+		bh.Logger.ErrorContext(r.Context(), "deleteBook", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusNoContent, utils.Envelope{"updated": true})
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // @desc    Borrow a book
-// @route   POST /api/books/{id}
+// @route   POST /api/books/{id}/borrow
 // @access  Private
 func (bh *BookHandler) HandleBorrowBook(w http.ResponseWriter, r *http.Request) {
 	bookID, err := utils.ReadIDParam(r)
 	if err != nil {
-		bh.Logger.Printf("ERROR: readIDParam: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid workout id"})
+		bh.Logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid book id"})
 		return
 	}
 
@@ -212,16 +275,35 @@ func (bh *BookHandler) HandleBorrowBook(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = bh.BookStore.BorrowBook(bookID, int64(currentUser.ID))
+	balance, err := bh.FineStore.GetBalance(int64(currentUser.ID))
 	if err != nil {
-		bh.Logger.Printf(w, "ERROR: HandleBorrowBook: %v", err)
+		bh.Logger.ErrorContext(r.Context(), "getBalance", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if balance > bh.MaxFineBalance {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "outstanding fines must be paid before borrowing", "balance_cents": balance})
+		return
+	}
+
+	loan, err := bh.BookStore.BorrowBook(bookID, int64(currentUser.ID), bh.LoanPeriod)
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "book not found"})
+		return
+	}
+
+	if err == store.ErrBookUnavailable {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "no copies available; place a hold to join the queue"})
 		return
 	}
 
 	if err != nil {
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "error deleting workout"})
+		bh.Logger.ErrorContext(r.Context(), "borrowBook", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusNoContent, utils.Envelope{"updated": true})
-}
\ No newline at end of file
+	bh.Metrics.BooksBorrowed.Inc()
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"loan": loan})
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kevin120202/library-management-system/internal/store"
+)
+
+type fakeBookStore struct {
+	store.BookStore
+	deleteErr error
+}
+
+func (s *fakeBookStore) DeleteBook(id int64) error {
+	return s.deleteErr
+}
+
+// withURLParams sets chi route parameters, given as name, value pairs, on r
+// as the router would.
+func withURLParams(r *http.Request, pairs ...string) *http.Request {
+	routeCtx := chi.NewRouteContext()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		routeCtx.URLParams.Add(pairs[i], pairs[i+1])
+	}
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, routeCtx))
+}
+
+func TestHandleDeleteBookByID(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		deleteErr  error
+		wantStatus int
+		wantError  string
+	}{
+		{"deleted", "1", nil, http.StatusNoContent, ""},
+		{"bad id", "abc", nil, http.StatusBadRequest, "invalid book id"},
+		{"missing", "1", sql.ErrNoRows, http.StatusNotFound, "book not found"},
+		{"has loans", "1", store.ErrBookHasLoans, http.StatusConflict, "book has loan history; withdraw its items instead"},
+		{"store failure", "1", errors.New("connection reset"), http.StatusInternalServerError, "internal server error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &BookHandler{BookStore: &fakeBookStore{deleteErr: tt.deleteErr}, Logger: discardLogger}
+
+			r := withURLParams(httptest.NewRequest(http.MethodDelete, "/api/books/"+tt.id, nil), "id", tt.id)
+			w := httptest.NewRecorder()
+
+			h.HandleDeleteBookByID(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantError == "" {
+				if w.Body.Len() != 0 {
+					t.Fatalf("body = %q, want none", w.Body.String())
+				}
+				return
+			}
+
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not JSON: %v", w.Body.String(), err)
+			}
+			if body["error"] != tt.wantError {
+				t.Fatalf("error = %q, want %q", body["error"], tt.wantError)
+			}
+		})
+	}
+}
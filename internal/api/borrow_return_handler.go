@@ -1,2 +1,190 @@
 package api
 
+import (
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/kevin120202/library-management-system/internal/metrics"
+	"github.com/kevin120202/library-management-system/internal/middleware"
+	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/utils"
+)
+
+type BorrowReturnHandler struct {
+	borrowReturnStore store.BorrowBookStore
+	logger            *slog.Logger
+	loanPeriod        time.Duration
+	maxRenewals       int
+	pickupWindow      time.Duration
+	metrics           *metrics.Metrics
+}
+
+func NewBorrowReturnHandler(borrowReturnStore store.BorrowBookStore, logger *slog.Logger, loanPeriod time.Duration, maxRenewals int, pickupWindow time.Duration, metrics *metrics.Metrics) *BorrowReturnHandler {
+	return &BorrowReturnHandler{
+		borrowReturnStore: borrowReturnStore,
+		logger:            logger,
+		loanPeriod:        loanPeriod,
+		maxRenewals:       maxRenewals,
+		pickupWindow:      pickupWindow,
+		metrics:           metrics,
+	}
+}
+
+// loadOwnLoan reads the loan from the URL and makes sure the current user is
+// allowed to act on it. It writes the error response itself and returns nil
+// when the request should stop.
+func (h *BorrowReturnHandler) loadOwnLoan(w http.ResponseWriter, r *http.Request) *store.Loan {
+	loanID, err := utils.ReadIDParam(r)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid loan id"})
+		return nil
+	}
+
+	loan, err := h.borrowReturnStore.GetLoanByID(loanID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getLoanByID", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil
+	}
+
+	if loan == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "loan not found"})
+		return nil
+	}
+
+	currentUser := middleware.GetUser(r)
+	if loan.UserID != currentUser.ID && !currentUser.HasPermission("loans:override") {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you are not authorized to modify this loan"})
+		return nil
+	}
+
+	return loan
+}
+
+// @desc    Return a borrowed book
+// @route   POST /api/loans/{id}/return
+// @access  Private
+func (h *BorrowReturnHandler) HandleReturnBook(w http.ResponseWriter, r *http.Request) {
+	loan := h.loadOwnLoan(w, r)
+	if loan == nil {
+		return
+	}
+
+	returnedLoan, err := h.borrowReturnStore.ReturnBook(int64(loan.ID), h.pickupWindow)
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "loan not found"})
+		return
+	}
+
+	if err == store.ErrLoanReturned {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "loan has already been returned"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "returnBook", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.metrics.BooksReturned.Inc()
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"loan": returnedLoan})
+}
+
+// @desc    Renew a loan
+// @route   POST /api/loans/{id}/renew
+// @access  Private
+func (h *BorrowReturnHandler) HandleRenewBook(w http.ResponseWriter, r *http.Request) {
+	loan := h.loadOwnLoan(w, r)
+	if loan == nil {
+		return
+	}
+
+	renewedLoan, err := h.borrowReturnStore.RenewBook(int64(loan.ID), h.loanPeriod, h.maxRenewals)
+	if err == store.ErrLoanReturned {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "loan has already been returned"})
+		return
+	}
+
+	if err == store.ErrRenewalLimitReached {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "maximum number of renewals reached"})
+		return
+	}
+
+	if err == store.ErrBookOnHold {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "book has been requested by another patron"})
+		return
+	}
+
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "loan not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "renewBook", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"loan": renewedLoan})
+}
+
+func (h *BorrowReturnHandler) listLoans(w http.ResponseWriter, r *http.Request, userID *int64) {
+	listParams, err := readListParams(r, []string{"borrowed_at", "due_at"}, "borrowed_at")
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	bookID, err := readOptionalID(r, "book_id")
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	params := store.LoanListParams{
+		ListParams: listParams,
+		UserID:     userID,
+		BookID:     bookID,
+		Status:     r.URL.Query().Get("status"),
+	}
+
+	page, err := h.borrowReturnStore.ListLoans(params)
+	if err == store.ErrInvalidFilter {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "status must be open, returned or overdue"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "listLoans", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, pageEnvelope("loans", page))
+}
+
+// @desc    List all loans
+// @route   GET /api/loans?limit=&cursor=&sort=&order=&user_id=&book_id=&status=
+// @access  Private (loans:override)
+func (h *BorrowReturnHandler) HandleListLoans(w http.ResponseWriter, r *http.Request) {
+	userID, err := readOptionalID(r, "user_id")
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	h.listLoans(w, r, userID)
+}
+
+// @desc    List the current user's loans
+// @route   GET /api/users/me/loans?limit=&cursor=&sort=&order=&book_id=&status=
+// @access  Private
+func (h *BorrowReturnHandler) HandleGetMyLoans(w http.ResponseWriter, r *http.Request) {
+	userID := int64(middleware.GetUser(r).ID)
+	h.listLoans(w, r, &userID)
+}
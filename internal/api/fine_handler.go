@@ -0,0 +1,124 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/kevin120202/library-management-system/internal/middleware"
+	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/utils"
+)
+
+type createPaymentRequest struct {
+	AmountCents int    `json:"amount_cents"`
+	Kind        string `json:"kind"`
+	Note        string `json:"note"`
+}
+
+type FineHandler struct {
+	fineStore store.FineStore
+	logger    *slog.Logger
+}
+
+func NewFineHandler(fineStore store.FineStore, logger *slog.Logger) *FineHandler {
+	return &FineHandler{
+		fineStore: fineStore,
+		logger:    logger,
+	}
+}
+
+// @desc    Get the current user's fines and balance
+// @route   GET /api/users/me/fines
+// @access  Private
+func (h *FineHandler) HandleGetMyFines(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	userID := int64(currentUser.ID)
+
+	balance, err := h.fineStore.GetBalance(userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getBalance", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	fines, err := h.fineStore.GetFinesForUser(userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getFinesForUser", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	payments, err := h.fineStore.GetPaymentsForUser(userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getPaymentsForUser", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"balance_cents": balance, "fines": fines, "payments": payments})
+}
+
+// @desc    Record a payment or waiver against a user's fines
+// @route   POST /api/users/{id}/payments
+// @access  Private (fines:manage)
+func (h *FineHandler) HandleCreatePayment(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	userID, err := utils.ReadIDParam(r)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid user id"})
+		return
+	}
+
+	var req createPaymentRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingCreatePayment", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.AmountCents <= 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "amount_cents must be greater than zero"})
+		return
+	}
+
+	if req.Kind == "" {
+		req.Kind = "payment"
+	}
+
+	if req.Kind != "payment" && req.Kind != "waiver" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "kind must be payment or waiver"})
+		return
+	}
+
+	payment := &store.Payment{
+		UserID:      int(userID),
+		AmountCents: req.AmountCents,
+		Kind:        req.Kind,
+		Note:        req.Note,
+		RecordedBy:  &currentUser.ID,
+	}
+
+	err = h.fineStore.RecordPayment(payment)
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return
+	}
+
+	if err == store.ErrPaymentExceedsBalance {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "payment exceeds outstanding balance"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "recordPayment", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"payment": payment})
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/kevin120202/library-management-system/internal/middleware"
+	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/utils"
+)
+
+type HoldHandler struct {
+	holdStore    store.HoldStore
+	logger       *slog.Logger
+	pickupWindow time.Duration
+}
+
+func NewHoldHandler(holdStore store.HoldStore, logger *slog.Logger, pickupWindow time.Duration) *HoldHandler {
+	return &HoldHandler{
+		holdStore:    holdStore,
+		logger:       logger,
+		pickupWindow: pickupWindow,
+	}
+}
+
+// expireStaleHolds moves the queue along before we report on it, so patrons
+// never see a hold that has already lapsed.
+func (h *HoldHandler) expireStaleHolds(ctx context.Context) {
+	_, err := h.holdStore.ExpireStaleHolds(h.pickupWindow)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "expireStaleHolds", "error", err)
+	}
+}
+
+// @desc    Place a hold on a book
+// @route   POST /api/books/{id}/holds
+// @access  Private
+func (h *HoldHandler) HandleCreateHold(w http.ResponseWriter, r *http.Request) {
+	bookID, err := utils.ReadIDParam(r)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid book id"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	h.expireStaleHolds(r.Context())
+
+	hold, err := h.holdStore.CreateHold(bookID, int64(currentUser.ID))
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "book not found"})
+		return
+	}
+
+	if err == store.ErrBookAvailable {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "a copy is available; borrow it instead"})
+		return
+	}
+
+	if err == store.ErrDuplicateHold {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "you already have a hold on this book"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "createHold", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"hold": hold})
+}
+
+// @desc    Get the current user's holds
+// @route   GET /api/users/me/holds
+// @access  Private
+func (h *HoldHandler) HandleGetMyHolds(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	h.expireStaleHolds(r.Context())
+
+	holds, err := h.holdStore.GetActiveHoldsForUser(int64(currentUser.ID))
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getActiveHoldsForUser", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"holds": holds})
+}
@@ -0,0 +1,326 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/utils"
+)
+
+var (
+	itemConditions = []string{"new", "good", "fair", "poor", "damaged"}
+	// on_loan and on_hold are missing on purpose: only borrowing, returning
+	// and holds move a copy in and out of circulation.
+	itemStatuses = []string{"available", "maintenance", "lost", "withdrawn"}
+)
+
+type itemRequest struct {
+	Barcode       *string `json:"barcode"`
+	ShelfLocation *string `json:"shelf_location"`
+	Condition     *string `json:"condition"`
+	Status        *string `json:"status"`
+}
+
+type ItemHandler struct {
+	itemStore store.ItemStore
+	bookStore store.BookStore
+	logger    *slog.Logger
+}
+
+func NewItemHandler(itemStore store.ItemStore, bookStore store.BookStore, logger *slog.Logger) *ItemHandler {
+	return &ItemHandler{
+		itemStore: itemStore,
+		bookStore: bookStore,
+		logger:    logger,
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *ItemHandler) validateItem(item *store.Item) error {
+	if item.Barcode == "" {
+		return errors.New("barcode is required")
+	}
+	if len(item.Barcode) > 64 {
+		return errors.New("barcode cannot be greater than 64 characters")
+	}
+	if len(item.ShelfLocation) > 100 {
+		return errors.New("shelf location cannot be greater than 100 characters")
+	}
+	if !contains(itemConditions, item.Condition) {
+		return errors.New("condition must be one of " + strings.Join(itemConditions, ", "))
+	}
+	if !contains(itemStatuses, item.Status) && item.Status != "on_loan" && item.Status != "on_hold" {
+		return errors.New("status must be one of " + strings.Join(itemStatuses, ", "))
+	}
+
+	return nil
+}
+
+// loadItem reads the book and item ids from the URL and returns the item
+// only when it belongs to that book. It writes the error response itself and
+// returns nil when the request should stop.
+func (h *ItemHandler) loadItem(w http.ResponseWriter, r *http.Request) *store.Item {
+	bookID, err := utils.ReadIDParam(r)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid book id"})
+		return nil
+	}
+
+	itemID, err := utils.ReadNamedIDParam(r, "itemID")
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "readNamedIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid item id"})
+		return nil
+	}
+
+	item, err := h.itemStore.GetItemByID(itemID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getItemByID", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil
+	}
+
+	if item == nil || int64(item.BookID) != bookID {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "item not found"})
+		return nil
+	}
+
+	return item
+}
+
+// @desc    Get copies of a book
+// @route   GET /api/books/{id}/items
+// @access  Private
+func (h *ItemHandler) HandleGetItems(w http.ResponseWriter, r *http.Request) {
+	bookID, err := utils.ReadIDParam(r)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid book id"})
+		return
+	}
+
+	book, err := h.bookStore.GetBookByID(bookID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getBookByID", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if book == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "book not found"})
+		return
+	}
+
+	items, err := h.itemStore.GetItemsForBook(bookID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getItemsForBook", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"items": items})
+}
+
+// @desc    Get a single copy of a book
+// @route   GET /api/books/{id}/items/{itemID}
+// @access  Private
+func (h *ItemHandler) HandleGetItemByID(w http.ResponseWriter, r *http.Request) {
+	item := h.loadItem(w, r)
+	if item == nil {
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"item": item})
+}
+
+// @desc    Add a copy of a book
+// @route   POST /api/books/{id}/items
+// @access  Private (books:write)
+func (h *ItemHandler) HandleCreateItem(w http.ResponseWriter, r *http.Request) {
+	bookID, err := utils.ReadIDParam(r)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid book id"})
+		return
+	}
+
+	var req itemRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingCreateItem", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	book, err := h.bookStore.GetBookByID(bookID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getBookByID", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if book == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "book not found"})
+		return
+	}
+
+	item := &store.Item{
+		BookID:    book.ID,
+		Condition: "good",
+		Status:    "available",
+	}
+	if req.Barcode != nil {
+		item.Barcode = strings.TrimSpace(*req.Barcode)
+	}
+	if req.ShelfLocation != nil {
+		item.ShelfLocation = *req.ShelfLocation
+	}
+	if req.Condition != nil {
+		item.Condition = *req.Condition
+	}
+	if req.Status != nil {
+		if !contains(itemStatuses, *req.Status) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "status must be one of " + strings.Join(itemStatuses, ", ")})
+			return
+		}
+		item.Status = *req.Status
+	}
+
+	err = h.validateItem(item)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	err = h.itemStore.CreateItem(item)
+	if err == store.ErrDuplicateBarcode {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "barcode already in use"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "createItem", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create item"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"item": item})
+}
+
+// @desc    Update a copy of a book
+// @route   PUT /api/books/{id}/items/{itemID}
+// @access  Private (books:write)
+func (h *ItemHandler) HandleUpdateItem(w http.ResponseWriter, r *http.Request) {
+	item := h.loadItem(w, r)
+	if item == nil {
+		return
+	}
+
+	var req itemRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingUpdateItem", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Barcode != nil {
+		item.Barcode = strings.TrimSpace(*req.Barcode)
+	}
+	if req.ShelfLocation != nil {
+		item.ShelfLocation = *req.ShelfLocation
+	}
+	if req.Condition != nil {
+		item.Condition = *req.Condition
+	}
+	if req.Status != nil && *req.Status != item.Status {
+		if !contains(itemStatuses, *req.Status) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "status must be one of " + strings.Join(itemStatuses, ", ")})
+			return
+		}
+		item.Status = *req.Status
+	}
+
+	err = h.validateItem(item)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	err = h.itemStore.UpdateItem(item)
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "item not found"})
+		return
+	}
+
+	if err == store.ErrDuplicateBarcode {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "barcode already in use"})
+		return
+	}
+
+	if err == store.ErrItemOnLoan {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "item is on loan and must be returned first"})
+		return
+	}
+
+	if err == store.ErrItemOnHold {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "item is set aside for a ready hold; it must be collected or the hold cancelled first"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "updateItem", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"item": item})
+}
+
+// @desc    Delete a copy of a book
+// @route   DELETE /api/books/{id}/items/{itemID}
+// @access  Private (books:write)
+func (h *ItemHandler) HandleDeleteItem(w http.ResponseWriter, r *http.Request) {
+	item := h.loadItem(w, r)
+	if item == nil {
+		return
+	}
+
+	err := h.itemStore.DeleteItem(int64(item.ID))
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "item not found"})
+		return
+	}
+
+	if err == store.ErrItemHasLoans {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "item has loan history; mark it withdrawn instead"})
+		return
+	}
+
+	if err == store.ErrItemOnHold {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "item is set aside for a ready hold; it must be collected or the hold cancelled first"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "deleteItem", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "error deleting item"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
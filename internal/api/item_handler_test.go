@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kevin120202/library-management-system/internal/store"
+)
+
+type fakeItemStore struct {
+	store.ItemStore
+	item      store.Item
+	updateErr error
+	deleteErr error
+	updated   *store.Item
+}
+
+func (s *fakeItemStore) GetItemByID(id int64) (*store.Item, error) {
+	item := s.item
+	return &item, nil
+}
+
+func (s *fakeItemStore) DeleteItem(id int64) error {
+	return s.deleteErr
+}
+
+func (s *fakeItemStore) UpdateItem(item *store.Item) error {
+	s.updated = item
+	return s.updateErr
+}
+
+func TestHandleUpdateItemOnHold(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		updateErr  error
+		wantStatus int
+		wantError  string
+	}{
+		{"shelf location", `{"shelf_location": "Hold shelf 3"}`, nil, http.StatusOK, ""},
+		{"condition", `{"condition": "fair"}`, nil, http.StatusOK, ""},
+		{"status change refused", `{"status": "available"}`, store.ErrItemOnHold, http.StatusConflict, "item is set aside for a ready hold; it must be collected or the hold cancelled first"},
+		{"unknown status", `{"status": "on_hold_forever"}`, nil, http.StatusBadRequest, "status must be one of available, maintenance, lost, withdrawn"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			itemStore := &fakeItemStore{
+				item:      store.Item{ID: 3, BookID: 1, Barcode: "B0001", Condition: "good", Status: "on_hold"},
+				updateErr: tt.updateErr,
+			}
+			h := NewItemHandler(itemStore, nil, discardLogger)
+
+			r := withURLParams(httptest.NewRequest(http.MethodPut, "/api/books/1/items/3", strings.NewReader(tt.body)), "id", "1", "itemID", "3")
+			w := httptest.NewRecorder()
+
+			h.HandleUpdateItem(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+
+			if tt.wantError == "" {
+				if itemStore.updated == nil || itemStore.updated.Status != "on_hold" {
+					t.Fatalf("updated item = %+v, want it saved still on_hold", itemStore.updated)
+				}
+				return
+			}
+
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not JSON: %v", w.Body.String(), err)
+			}
+			if body["error"] != tt.wantError {
+				t.Fatalf("error = %q, want %q", body["error"], tt.wantError)
+			}
+		})
+	}
+}
+
+func TestHandleDeleteItemOnHold(t *testing.T) {
+	itemStore := &fakeItemStore{
+		item:      store.Item{ID: 3, BookID: 1, Barcode: "B0001", Condition: "good", Status: "on_hold"},
+		deleteErr: store.ErrItemOnHold,
+	}
+	h := NewItemHandler(itemStore, nil, discardLogger)
+
+	r := withURLParams(httptest.NewRequest(http.MethodDelete, "/api/books/1/items/3", nil), "id", "1", "itemID", "3")
+	w := httptest.NewRecorder()
+
+	h.HandleDeleteItem(w, r)
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want %d; body %s", w.Code, http.StatusConflict, w.Body.String())
+	}
+}
@@ -0,0 +1,28 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/kevin120202/library-management-system/internal/scheduler"
+	"github.com/kevin120202/library-management-system/internal/utils"
+)
+
+type JobHandler struct {
+	scheduler *scheduler.Scheduler
+	logger    *slog.Logger
+}
+
+func NewJobHandler(scheduler *scheduler.Scheduler, logger *slog.Logger) *JobHandler {
+	return &JobHandler{
+		scheduler: scheduler,
+		logger:    logger,
+	}
+}
+
+// @desc    Get background job status
+// @route   GET /api/admin/jobs
+// @access  Private (jobs:read)
+func (h *JobHandler) HandleGetJobs(w http.ResponseWriter, r *http.Request) {
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"jobs": h.scheduler.Statuses()})
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/kevin120202/library-management-system/internal/mailer"
+)
+
+const mailSendTimeout = 30 * time.Second
+
+// sendMailAsync delivers msg after the handler has responded, so a slow mail
+// server neither delays the client nor, through timing, reveals whether an
+// account exists. Failures are only logged.
+func sendMailAsync(ctx context.Context, m mailer.Mailer, logger *slog.Logger, msg mailer.Message) {
+	go func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, mailSendTimeout)
+		defer cancel()
+
+		err := m.Send(ctx, msg)
+		if err != nil {
+			logger.ErrorContext(ctx, "sendMail", "subject", msg.Subject, "error", err)
+		}
+	}(context.WithoutCancel(ctx))
+}
@@ -0,0 +1,317 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kevin120202/library-management-system/internal/sso"
+	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/utils"
+)
+
+var (
+	errOIDCEmailTaken = errors.New("an account with this email already exists")
+	errOIDCNoAccount  = errors.New("no library account is linked to this identity")
+
+	usernameUnsafeChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+)
+
+// oidcStateCookie ties a sign-in to the browser that started it, so a
+// callback URL carrying someone else's state cannot be completed elsewhere.
+const oidcStateCookie = "oidc_state"
+
+// OIDCPolicy decides what happens to users arriving from the identity
+// provider; see config.OIDCConfig.
+type OIDCPolicy struct {
+	GroupRoles         map[string]string
+	DefaultAccountType string
+	AutoProvision      bool
+	SyncRoles          bool
+	StateTTL           time.Duration
+	// SecureCookie marks the state cookie Secure; set it when the callback
+	// is served over HTTPS.
+	SecureCookie bool
+}
+
+type OIDCHandler struct {
+	client          *sso.Client
+	oidcStore       store.OIDCStore
+	userStore       store.UserStore
+	permissionStore store.PermissionStore
+	tokenHandler    *TokenHandler
+	logger          *slog.Logger
+	policy          OIDCPolicy
+}
+
+// NewOIDCHandler finishes sign-ins through tokenHandler, so single sign-on
+// users get the same tokens, and two-factor challenges, as password logins.
+func NewOIDCHandler(client *sso.Client, oidcStore store.OIDCStore, userStore store.UserStore, permissionStore store.PermissionStore, tokenHandler *TokenHandler, logger *slog.Logger, policy OIDCPolicy) *OIDCHandler {
+	return &OIDCHandler{
+		client:          client,
+		oidcStore:       oidcStore,
+		userStore:       userStore,
+		permissionStore: permissionStore,
+		tokenHandler:    tokenHandler,
+		logger:          logger,
+		policy:          policy,
+	}
+}
+
+// @desc    Start single sign-on by redirecting to the identity provider
+// @route   GET /api/auth/oidc/login
+// @access  Public
+func (h *OIDCHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	login, err := h.client.Begin(ctx)
+	if errors.Is(err, sso.ErrProviderUnavailable) {
+		h.logger.ErrorContext(r.Context(), "oidcBegin", "error", err)
+		utils.WriteJSON(w, http.StatusServiceUnavailable, utils.Envelope{"error": "single sign-on is temporarily unavailable"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "oidcBegin", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.oidcStore.CreateLoginState(login.State, store.OIDCLoginState{CodeVerifier: login.CodeVerifier, Nonce: login.Nonce}, h.policy.StateTTL)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "createLoginState", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.setStateCookie(w, login.State, int(h.policy.StateTTL.Seconds()))
+	http.Redirect(w, r, login.URL, http.StatusFound)
+}
+
+// setStateCookie stores state for the callback; a negative maxAge clears it.
+// SameSite=Lax still sends it on the provider's top-level redirect back.
+func (h *OIDCHandler) setStateCookie(w http.ResponseWriter, state string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   h.policy.SecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// @desc    Finish single sign-on and issue a library token pair or two-factor challenge
+// @route   GET /api/auth/oidc/callback
+// @access  Public
+func (h *OIDCHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if providerErr := query.Get("error"); providerErr != "" {
+		h.logger.WarnContext(r.Context(), "oidc sign-in refused", "error", providerErr, "description", query.Get("error_description"))
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "sign-in was cancelled or refused by the identity provider"})
+		return
+	}
+
+	code, state := query.Get("code"), query.Get("state")
+	if code == "" || state == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "code and state are required"})
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "sign-in was started in another browser or has expired; please start again"})
+		return
+	}
+	h.setStateCookie(w, "", -1)
+
+	loginState, err := h.oidcStore.ConsumeLoginState(state)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "consumeLoginState", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if loginState == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "sign-in request expired or invalid; please start again"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	identity, err := h.client.Finish(ctx, code, loginState.CodeVerifier, loginState.Nonce)
+	if errors.Is(err, sso.ErrProviderUnavailable) {
+		h.logger.ErrorContext(r.Context(), "oidcFinish", "error", err)
+		utils.WriteJSON(w, http.StatusServiceUnavailable, utils.Envelope{"error": "single sign-on is temporarily unavailable"})
+		return
+	}
+
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "oidc sign-in failed", "error", err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "could not verify sign-in with the identity provider"})
+		return
+	}
+
+	if identity.Email == "" {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "the identity provider did not share an email address"})
+		return
+	}
+
+	user, err := h.resolveUser(r.Context(), identity)
+	if err == errOIDCEmailTaken {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "an account with this email already exists; verify the address with your identity provider to link it"})
+		return
+	}
+
+	if err == errOIDCNoAccount {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "resolveOIDCUser", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.oidcStore.LinkIdentity(user.ID, identity.Issuer, identity.Subject, identity.Email)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "linkIdentity", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.tokenHandler.completeLogin(w, r, user)
+}
+
+// resolveUser finds the account for identity: one already linked to it, else
+// one with the same email if the provider has verified that address, else a
+// newly provisioned one. Provisioned accounts get their account type from
+// the user's groups; existing ones only when the policy syncs roles.
+func (h *OIDCHandler) resolveUser(ctx context.Context, identity *sso.Identity) (*store.User, error) {
+	role, err := h.roleForGroups(identity.Groups)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := h.oidcStore.GetUserByIdentity(identity.Issuer, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		user, err = h.userStore.GetUserByEmail(identity.Email)
+		if err != nil {
+			return nil, err
+		}
+		if user != nil && !identity.EmailVerified {
+			return nil, errOIDCEmailTaken
+		}
+	}
+
+	if user == nil {
+		if !h.policy.AutoProvision {
+			return nil, errOIDCNoAccount
+		}
+		if role == "" {
+			role = h.policy.DefaultAccountType
+		}
+		return h.provisionUser(ctx, identity, role)
+	}
+
+	if !user.Activated && identity.EmailVerified {
+		err = h.userStore.ActivateUser(user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if h.policy.SyncRoles && role != "" && role != user.AccountType {
+		_, err = h.userStore.UpdateUserRole(int64(user.ID), role)
+		if err != nil {
+			return nil, err
+		}
+		h.logger.WarnContext(ctx, "account type changed by identity provider groups", "user_id", user.ID, "issuer", identity.Issuer, "subject", identity.Subject, "from", user.AccountType, "to", role)
+		user.AccountType = role
+	}
+
+	return user, nil
+}
+
+// roleForGroups returns the mapped account type with the most permissions
+// among the user's groups, or "" when none of the groups is mapped.
+func (h *OIDCHandler) roleForGroups(groups []string) (string, error) {
+	best, bestPermissions := "", -1
+	for _, group := range groups {
+		role, ok := h.policy.GroupRoles[group]
+		if !ok || role == best {
+			continue
+		}
+
+		permissions, err := h.permissionStore.GetPermissionsForRole(role)
+		if err != nil {
+			return "", err
+		}
+
+		if len(permissions) > bestPermissions || (len(permissions) == bestPermissions && role < best) {
+			best, bestPermissions = role, len(permissions)
+		}
+	}
+	return best, nil
+}
+
+// provisionUser creates an account for a first-time single sign-on user. It
+// gets a random password nobody knows; the user can set a real one through a
+// password reset if they ever need to sign in without the provider.
+func (h *OIDCHandler) provisionUser(ctx context.Context, identity *sso.Identity, role string) (*store.User, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	base = usernameUnsafeChars.ReplaceAllString(base, "")
+	if len(base) > 40 {
+		base = base[:40]
+	}
+	if base == "" {
+		base = "user"
+	}
+
+	user := &store.User{
+		Email:       identity.Email,
+		AccountType: role,
+		Activated:   identity.EmailVerified,
+	}
+
+	err := user.PasswordHash.Set(rand.Text())
+	if err != nil {
+		return nil, err
+	}
+
+	// Usernames from the provider may collide with existing accounts, so
+	// retry with a random suffix a few times.
+	user.Username = base
+	for range 5 {
+		err = h.userStore.CreateUser(user)
+		if err != store.ErrDuplicateUser {
+			break
+		}
+		user.Username = base + "-" + strings.ToLower(rand.Text()[:6])
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	h.logger.InfoContext(ctx, "provisioned user from identity provider", "user_id", user.ID, "issuer", identity.Issuer)
+	return user, nil
+}
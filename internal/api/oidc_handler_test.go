@@ -0,0 +1,226 @@
+package api
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kevin120202/library-management-system/internal/sso"
+	"github.com/kevin120202/library-management-system/internal/store"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+type fakeOIDCStore struct {
+	store.OIDCStore
+	states   map[string]*store.OIDCLoginState
+	linked   map[string]*store.User
+	consumed []string
+}
+
+func (f *fakeOIDCStore) ConsumeLoginState(state string) (*store.OIDCLoginState, error) {
+	f.consumed = append(f.consumed, state)
+	loginState := f.states[state]
+	delete(f.states, state)
+	return loginState, nil
+}
+
+func (f *fakeOIDCStore) GetUserByIdentity(issuer, subject string) (*store.User, error) {
+	return f.linked[issuer+"|"+subject], nil
+}
+
+type fakeUserStore struct {
+	store.UserStore
+	byEmail     map[string]*store.User
+	created     []*store.User
+	roleChanges map[int]string
+}
+
+func (f *fakeUserStore) GetUserByEmail(email string) (*store.User, error) {
+	return f.byEmail[email], nil
+}
+
+func (f *fakeUserStore) CreateUser(user *store.User) error {
+	user.ID = 100 + len(f.created)
+	f.created = append(f.created, user)
+	return nil
+}
+
+func (f *fakeUserStore) ActivateUser(user *store.User) error {
+	user.Activated = true
+	return nil
+}
+
+func (f *fakeUserStore) UpdateUserRole(userID int64, role string) (*store.User, error) {
+	if f.roleChanges == nil {
+		f.roleChanges = map[int]string{}
+	}
+	f.roleChanges[int(userID)] = role
+	return &store.User{ID: int(userID), AccountType: role}, nil
+}
+
+type fakePermissionStore struct {
+	store.PermissionStore
+	roles map[string][]string
+}
+
+func (f *fakePermissionStore) GetPermissionsForRole(role string) ([]string, error) {
+	return f.roles[role], nil
+}
+
+func TestCallbackRequiresStateFromSameBrowser(t *testing.T) {
+	tests := []struct {
+		name        string
+		cookie      string
+		wantConsume bool
+	}{
+		{name: "no cookie"},
+		{name: "cookie for another sign-in", cookie: "other-state"},
+		{name: "matching cookie, unknown state", cookie: "state-1", wantConsume: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oidcStore := &fakeOIDCStore{states: map[string]*store.OIDCLoginState{}}
+			h := NewOIDCHandler(nil, oidcStore, &fakeUserStore{}, &fakePermissionStore{}, nil, discardLogger, OIDCPolicy{})
+
+			r := httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?code=abc&state=state-1", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+
+			h.HandleCallback(w, r)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400", w.Code)
+			}
+			if consumed := len(oidcStore.consumed) > 0; consumed != tt.wantConsume {
+				t.Fatalf("login state consumed = %v, want %v", consumed, tt.wantConsume)
+			}
+		})
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	patron := func() *store.User {
+		return &store.User{ID: 7, Username: "reader", Email: "reader@example.com", AccountType: "patron"}
+	}
+
+	identity := func(verified bool, groups ...string) *sso.Identity {
+		return &sso.Identity{Issuer: "https://idp.test", Subject: "user-1", Email: "reader@example.com", EmailVerified: verified, PreferredUsername: "reader", Groups: groups}
+	}
+
+	permissions := &fakePermissionStore{roles: map[string][]string{
+		"patron":    {"catalog:read"},
+		"librarian": {"catalog:read", "loans:manage"},
+		"admin":     {"catalog:read", "loans:manage", "users:manage"},
+	}}
+
+	groupRoles := map[string]string{"library-staff": "librarian", "it-admins": "admin"}
+
+	tests := []struct {
+		name        string
+		policy      OIDCPolicy
+		linked      *store.User
+		existing    *store.User
+		identity    *sso.Identity
+		wantErr     error
+		wantID      int
+		wantRole    string
+		wantCreated bool
+	}{
+		{
+			name:     "linked identity keeps its role without sync",
+			policy:   OIDCPolicy{GroupRoles: groupRoles},
+			linked:   patron(),
+			identity: identity(true, "it-admins"),
+			wantID:   7,
+			wantRole: "patron",
+		},
+		{
+			name:     "linked identity follows groups with sync",
+			policy:   OIDCPolicy{GroupRoles: groupRoles, SyncRoles: true},
+			linked:   patron(),
+			identity: identity(true, "library-staff"),
+			wantID:   7,
+			wantRole: "librarian",
+		},
+		{
+			name:     "verified email links existing account",
+			policy:   OIDCPolicy{GroupRoles: groupRoles},
+			existing: patron(),
+			identity: identity(true, "it-admins"),
+			wantID:   7,
+			wantRole: "patron",
+		},
+		{
+			name:     "unverified email does not link existing account",
+			policy:   OIDCPolicy{GroupRoles: groupRoles, AutoProvision: true},
+			existing: patron(),
+			identity: identity(false),
+			wantErr:  errOIDCEmailTaken,
+		},
+		{
+			name:        "new user provisioned with highest mapped role",
+			policy:      OIDCPolicy{GroupRoles: groupRoles, DefaultAccountType: "patron", AutoProvision: true},
+			identity:    identity(true, "library-staff", "it-admins"),
+			wantID:      100,
+			wantRole:    "admin",
+			wantCreated: true,
+		},
+		{
+			name:        "new user in no mapped group gets default role",
+			policy:      OIDCPolicy{GroupRoles: groupRoles, DefaultAccountType: "patron", AutoProvision: true},
+			identity:    identity(true, "somewhere-else"),
+			wantID:      100,
+			wantRole:    "patron",
+			wantCreated: true,
+		},
+		{
+			name:     "new user refused without auto-provisioning",
+			policy:   OIDCPolicy{GroupRoles: groupRoles, DefaultAccountType: "patron"},
+			identity: identity(true),
+			wantErr:  errOIDCNoAccount,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oidcStore := &fakeOIDCStore{linked: map[string]*store.User{}}
+			if tt.linked != nil {
+				oidcStore.linked["https://idp.test|user-1"] = tt.linked
+			}
+
+			userStore := &fakeUserStore{byEmail: map[string]*store.User{}}
+			if tt.existing != nil {
+				userStore.byEmail[tt.existing.Email] = tt.existing
+			}
+
+			tt.policy.StateTTL = time.Minute
+			h := NewOIDCHandler(nil, oidcStore, userStore, permissions, nil, discardLogger, tt.policy)
+
+			user, err := h.resolveUser(context.Background(), tt.identity)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if user.ID != tt.wantID || user.AccountType != tt.wantRole {
+				t.Errorf("user = %d/%s, want %d/%s", user.ID, user.AccountType, tt.wantID, tt.wantRole)
+			}
+			if created := len(userStore.created) > 0; created != tt.wantCreated {
+				t.Errorf("created = %v, want %v", created, tt.wantCreated)
+			}
+			if !tt.policy.SyncRoles && len(userStore.roleChanges) > 0 {
+				t.Errorf("existing account's role changed without sync: %v", userStore.roleChanges)
+			}
+		})
+	}
+}
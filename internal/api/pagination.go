@@ -0,0 +1,87 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/utils"
+)
+
+// readListParams reads the limit, cursor, sort and order query parameters
+// shared by every listing endpoint.
+func readListParams(r *http.Request, sorts []string, defaultSort string) (store.ListParams, error) {
+	query := r.URL.Query()
+
+	params := store.ListParams{
+		Limit: store.DefaultPageSize,
+		Sort:  defaultSort,
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > store.MaxPageSize {
+			return params, fmt.Errorf("limit must be between 1 and %d", store.MaxPageSize)
+		}
+		params.Limit = value
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		if !contains(sorts, sort) {
+			return params, errors.New("sort must be one of " + strings.Join(sorts, ", "))
+		}
+		params.Sort = sort
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		params.Descending = true
+	default:
+		return params, errors.New("order must be asc or desc")
+	}
+
+	if encoded := query.Get("cursor"); encoded != "" {
+		cursor, err := store.DecodeCursor(encoded)
+		if err != nil {
+			return params, errors.New("invalid cursor")
+		}
+		if cursor.Sort != params.Sort {
+			return params, errors.New("cursor was issued for a different sort")
+		}
+		params.After = cursor
+	}
+
+	return params, nil
+}
+
+// readOptionalID reads an integer query parameter that may be left out.
+func readOptionalID(r *http.Request, name string) (*int64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a number", name)
+	}
+
+	return &id, nil
+}
+
+func pageEnvelope[T any](key string, page *store.Page[T]) utils.Envelope {
+	var nextCursor any
+	if page.NextCursor != nil {
+		nextCursor = page.NextCursor.Encode()
+	}
+
+	return utils.Envelope{
+		key:              page.Items,
+		"next_cursor":    nextCursor,
+		"total_estimate": page.TotalEstimate,
+	}
+}
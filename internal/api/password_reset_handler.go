@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kevin120202/library-management-system/internal/mailer"
+	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/tokens"
+	"github.com/kevin120202/library-management-system/internal/utils"
+)
+
+type requestPasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type completePasswordResetRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type PasswordResetHandler struct {
+	userStore  store.UserStore
+	tokenStore store.TokenStore
+	mailer     mailer.Mailer
+	logger     *slog.Logger
+	resetTTL   time.Duration
+}
+
+func NewPasswordResetHandler(userStore store.UserStore, tokenStore store.TokenStore, mailer mailer.Mailer, logger *slog.Logger, resetTTL time.Duration) *PasswordResetHandler {
+	return &PasswordResetHandler{
+		userStore:  userStore,
+		tokenStore: tokenStore,
+		mailer:     mailer,
+		logger:     logger,
+		resetTTL:   resetTTL,
+	}
+}
+
+// @desc    Email a password reset token
+// @route   POST /api/password-reset
+// @access  Public
+func (h *PasswordResetHandler) HandleRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req requestPasswordResetRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingPasswordResetRequest", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if strings.TrimSpace(req.Email) == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "email is required"})
+		return
+	}
+
+	// The response is the same whether or not the address is registered, so
+	// the endpoint cannot be used to discover accounts.
+	accepted := utils.Envelope{"message": "if that email is registered, a password reset token has been sent to it"}
+
+	user, err := h.userStore.GetUserByEmail(strings.TrimSpace(req.Email))
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getUserByEmail", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusAccepted, accepted)
+		return
+	}
+
+	// Only the newest reset token is ever valid.
+	err = h.tokenStore.DeleteAllTokensForUser(user.ID, tokens.ScopePasswordReset)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "deleteResetTokens", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	token, err := h.tokenStore.CreateNewToken(user.ID, h.resetTTL, tokens.ScopePasswordReset)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "createResetToken", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your library password",
+		Body: fmt.Sprintf(
+			"Hello %s,\n\nSomeone asked to reset the password for your library account. "+
+				"To choose a new password, send this token to PUT /api/password-reset:\n\n    %s\n\n"+
+				"It expires at %s. If you did not ask for this, you can ignore this email; your password has not changed.\n",
+			user.Username, token.Plaintext, token.Expiry.UTC().Format(time.RFC1123),
+		),
+	}
+
+	sendMailAsync(r.Context(), h.mailer, h.logger, msg)
+	utils.WriteJSON(w, http.StatusAccepted, accepted)
+}
+
+// @desc    Set a new password with a reset token
+// @route   PUT /api/password-reset
+// @access  Public
+func (h *PasswordResetHandler) HandleCompletePasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req completePasswordResetRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingCompletePasswordReset", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Token == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "token is required"})
+		return
+	}
+
+	err = validatePassword(req.Password)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	user, err := h.userStore.GetUserToken(tokens.ScopePasswordReset, req.Token)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getUserToken", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid or expired password reset token"})
+		return
+	}
+
+	err = user.PasswordHash.Set(req.Password)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "hashing password", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.userStore.UpdatePassword(user)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "updatePassword", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "your password was reset; please log in again"})
+}
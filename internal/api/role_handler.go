@@ -0,0 +1,200 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/utils"
+)
+
+var roleNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_]{1,49}$`)
+
+type createRoleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+type setRolePermissionsRequest struct {
+	Permissions []string `json:"permissions"`
+}
+
+type RoleHandler struct {
+	permissionStore store.PermissionStore
+	logger          *slog.Logger
+}
+
+func NewRoleHandler(permissionStore store.PermissionStore, logger *slog.Logger) *RoleHandler {
+	return &RoleHandler{
+		permissionStore: permissionStore,
+		logger:          logger,
+	}
+}
+
+func (h *RoleHandler) validateCreateRoleRequest(req *createRoleRequest) error {
+	if req.Name == "" {
+		return errors.New("name is required")
+	}
+	if !roleNameRegex.MatchString(req.Name) {
+		return errors.New("name must be lowercase letters, digits or underscores")
+	}
+	return nil
+}
+
+// @desc    Get all permissions
+// @route   GET /api/admin/permissions
+// @access  Private (users:manage)
+func (h *RoleHandler) HandleGetPermissions(w http.ResponseWriter, r *http.Request) {
+	permissions, err := h.permissionStore.GetPermissions()
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getPermissions", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"permissions": permissions})
+}
+
+// @desc    Get all roles
+// @route   GET /api/admin/roles
+// @access  Private (users:manage)
+func (h *RoleHandler) HandleGetRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.permissionStore.GetRoles()
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getRoles", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"roles": roles})
+}
+
+// @desc    Create a role
+// @route   POST /api/admin/roles
+// @access  Private (users:manage)
+func (h *RoleHandler) HandleCreateRole(w http.ResponseWriter, r *http.Request) {
+	var req createRoleRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingCreateRole", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	err = h.validateCreateRoleRequest(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	role := &store.Role{
+		Name:        req.Name,
+		Description: req.Description,
+		Permissions: req.Permissions,
+	}
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+
+	err = h.permissionStore.CreateRole(role)
+	if err == store.ErrDuplicateRole {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "role already exists"})
+		return
+	}
+
+	if err == store.ErrUnknownPermission {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown permission"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "createRole", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"role": role})
+}
+
+// @desc    Replace the permissions granted to a role
+// @route   PUT /api/admin/roles/{name}/permissions
+// @access  Private (users:manage)
+func (h *RoleHandler) HandleSetRolePermissions(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	var req setRolePermissionsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingSetRolePermissions", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	err = h.permissionStore.SetRolePermissions(name, req.Permissions)
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "role not found"})
+		return
+	}
+
+	if err == store.ErrProtectedRole {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "the permissions of this role cannot be changed"})
+		return
+	}
+
+	if err == store.ErrUnknownPermission {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown permission"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "setRolePermissions", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	role, err := h.permissionStore.GetRole(name)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getRole", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"role": role})
+}
+
+// @desc    Delete a role
+// @route   DELETE /api/admin/roles/{name}
+// @access  Private (users:manage)
+func (h *RoleHandler) HandleDeleteRole(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	err := h.permissionStore.DeleteRole(name)
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "role not found"})
+		return
+	}
+
+	if err == store.ErrProtectedRole {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "this role cannot be deleted"})
+		return
+	}
+
+	if err == store.ErrRoleInUse {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "role is still assigned to users"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "deleteRole", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
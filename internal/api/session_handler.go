@@ -0,0 +1,75 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kevin120202/library-management-system/internal/middleware"
+	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/utils"
+)
+
+var sessionIDRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+type SessionHandler struct {
+	tokenStore store.TokenStore
+	logger     *slog.Logger
+}
+
+func NewSessionHandler(tokenStore store.TokenStore, logger *slog.Logger) *SessionHandler {
+	return &SessionHandler{
+		tokenStore: tokenStore,
+		logger:     logger,
+	}
+}
+
+// @desc    List the current user's active sessions
+// @route   GET /api/users/me/sessions
+// @access  Private
+func (h *SessionHandler) HandleGetMySessions(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	// A signed access token is not stored, so its session is found by ID.
+	var currentSessionID string
+	if claims := middleware.GetAccessClaims(r); claims != nil {
+		currentSessionID = claims.SessionID
+	}
+
+	sessions, err := h.tokenStore.ListSessions(currentUser.ID, middleware.GetToken(r), currentSessionID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "listSessions", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"sessions": sessions})
+}
+
+// @desc    Revoke one of the current user's sessions
+// @route   DELETE /api/users/me/sessions/{id}
+// @access  Private
+func (h *SessionHandler) HandleDeleteMySession(w http.ResponseWriter, r *http.Request) {
+	sessionID := chi.URLParam(r, "id")
+	if !sessionIDRegex.MatchString(sessionID) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid session id"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	deleted, err := h.tokenStore.DeleteSession(currentUser.ID, sessionID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "deleteSession", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !deleted {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "session not found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,18 +2,42 @@ package api
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/kevin120202/library-management-system/internal/metrics"
 	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/tokens"
 	"github.com/kevin120202/library-management-system/internal/utils"
 )
 
 type TokenHandler struct {
-	tokenStore store.TokenStore
-	userStore  store.UserStore
-	logger     *log.Logger
+	tokenStore     store.TokenStore
+	userStore      store.UserStore
+	throttleStore  store.LoginThrottleStore
+	twoFactorStore store.TwoFactorStore
+	logger         *slog.Logger
+	authTTL        time.Duration
+	refreshTTL     time.Duration
+	metrics        *metrics.Metrics
+	userThrottle   store.ThrottlePolicy
+	ipThrottle     store.ThrottlePolicy
+	twoFactor      TwoFactorPolicy
+
+	// signer and permissionStore are set when access tokens are signed
+	// rather than stored; see UseSignedAccessTokens.
+	signer          *tokens.Signer
+	permissionStore store.PermissionStore
+}
+
+// TwoFactorPolicy is how long a user has to enter a code after their
+// password, and whether admins must use two-factor authentication.
+type TwoFactorPolicy struct {
+	ChallengeTTL     time.Duration
+	RequireForAdmins bool
 }
 
 type createTokenRequest struct {
@@ -21,59 +45,337 @@ type createTokenRequest struct {
 	Password string `json:"password"`
 }
 
-func NewTokenHandler(tokenstore store.TokenStore, userStore store.UserStore, logger *log.Logger) *TokenHandler {
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type twoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+func NewTokenHandler(tokenstore store.TokenStore, userStore store.UserStore, throttleStore store.LoginThrottleStore, twoFactorStore store.TwoFactorStore, logger *slog.Logger, authTTL, refreshTTL time.Duration, metrics *metrics.Metrics, userThrottle, ipThrottle store.ThrottlePolicy, twoFactor TwoFactorPolicy) *TokenHandler {
 	return &TokenHandler{
-		tokenStore: tokenstore,
-		userStore:  userStore,
-		logger:     logger,
+		tokenStore:     tokenstore,
+		userStore:      userStore,
+		throttleStore:  throttleStore,
+		twoFactorStore: twoFactorStore,
+		logger:         logger,
+		authTTL:        authTTL,
+		refreshTTL:     refreshTTL,
+		metrics:        metrics,
+		userThrottle:   userThrottle,
+		ipThrottle:     ipThrottle,
+		twoFactor:      twoFactor,
+	}
+}
+
+// UseSignedAccessTokens makes the handler issue access tokens signed by
+// signer, carrying the permissions permissionStore reports for the user's
+// role, instead of storing them. Refresh tokens are stored either way.
+func (h *TokenHandler) UseSignedAccessTokens(signer *tokens.Signer, permissionStore store.PermissionStore) {
+	h.signer = signer
+	h.permissionStore = permissionStore
+}
+
+// storedAccessTTL is the lifetime of access tokens kept in the database, or
+// zero when access tokens are signed instead.
+func (h *TokenHandler) storedAccessTTL() time.Duration {
+	if h.signer != nil {
+		return 0
+	}
+	return h.authTTL
+}
+
+func (h *TokenHandler) signAccessToken(user *store.User, sessionID string) (*tokens.Token, error) {
+	permissions, err := h.permissionStore.GetPermissionsForRole(user.AccountType)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.signer.Sign(tokens.AccessClaims{
+		UserID:           user.ID,
+		Username:         user.Username,
+		Role:             user.AccountType,
+		Permissions:      permissions,
+		Activated:        user.Activated,
+		TwoFactorEnabled: user.TwoFactorEnabled,
+		SessionID:        sessionID,
+	}, h.authTTL)
+}
+
+func clientInfo(r *http.Request) store.ClientInfo {
+	userAgent := r.UserAgent()
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
 	}
+	return store.ClientInfo{UserAgent: userAgent, IP: utils.ClientIP(r)}
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, lockedUntil time.Time) {
+	retryAfter := int(math.Ceil(time.Until(lockedUntil).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{"error": "too many failed login attempts; try again later"})
 }
 
 // @desc    Create a token
 // @route   POST /api/authentication
-// @access  Private
+// @access  Public
 func (h *TokenHandler) HandleCreateToken(w http.ResponseWriter, r *http.Request) {
 	var req createTokenRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		h.logger.Printf("ERROR: createTokenRequest: %v", err)
+		h.logger.ErrorContext(r.Context(), "createTokenRequest", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
 		return
 	}
 
-	user, err := h.userStore.GetUserByUsername(req.Username)
+	ipKey := store.IPThrottleKey(utils.ClientIP(r))
+	userKey := store.UserThrottleKey(req.Username)
+
+	lockedUntil, err := h.throttleStore.LockedUntil(ipKey, userKey)
 	if err != nil {
-		h.logger.Printf("ERROR: GetUserByUsername: %v", err)
+		h.logger.ErrorContext(r.Context(), "lockedUntil", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
-	passwordsDoMatch, err := user.PasswordHash.Matches(req.Password)
+	if lockedUntil != nil {
+		writeTooManyAttempts(w, *lockedUntil)
+		return
+	}
+
+	user, err := h.userStore.GetUserByUsername(req.Username)
 	if err != nil {
-		h.logger.Printf("ERROR: PasswordHash.Matches %v", err)
+		h.logger.ErrorContext(r.Context(), "GetUserByUsername", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
+	passwordsDoMatch := false
+	if user == nil {
+		store.CompareDummyPassword(req.Password)
+	} else {
+		passwordsDoMatch, err = user.PasswordHash.Matches(req.Password)
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "PasswordHash.Matches", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
 	if !passwordsDoMatch {
+		h.metrics.FailedLogins.Inc()
+		h.recordFailure(r, ipKey, userKey)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid credentials"})
 		return
 	}
 
-	var scope string
-	if user.AccountType == "user" {
-		scope = "user"
+	err = h.throttleStore.Reset(userKey)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "resetThrottle", "error", err)
+	}
+
+	h.completeLogin(w, r, user)
+}
+
+// completeLogin finishes a login once the user has proven who they are. Users
+// with two-factor authentication get a short-lived challenge token to trade,
+// with a code, at /api/authentication/2fa; everyone else gets a token pair.
+func (h *TokenHandler) completeLogin(w http.ResponseWriter, r *http.Request, user *store.User) {
+	if !user.TwoFactorEnabled {
+		h.issueTokenPair(w, r, user)
+		return
+	}
+
+	challenge, err := h.tokenStore.CreateNewToken(user.ID, h.twoFactor.ChallengeTTL, tokens.ScopeTwoFactor)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "createTwoFactorChallenge", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"two_factor_required": true, "challenge_token": challenge})
+}
+
+func (h *TokenHandler) issueTokenPair(w http.ResponseWriter, r *http.Request, user *store.User) {
+	access, refresh, err := h.tokenStore.CreateTokenPair(user.ID, h.storedAccessTTL(), h.refreshTTL, clientInfo(r))
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "Creating Token", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if h.signer != nil {
+		access, err = h.signAccessToken(user, refresh.FamilyID)
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "signAccessToken", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	response := utils.Envelope{"auth_token": access, "refresh_token": refresh}
+	if h.twoFactor.RequireForAdmins && user.IsAdmin() && !user.TwoFactorEnabled {
+		response["two_factor_setup_required"] = true
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, response)
+}
+
+// @desc    Complete a login with a two-factor code or recovery code
+// @route   POST /api/authentication/2fa
+// @access  Public
+func (h *TokenHandler) HandleTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var req twoFactorLoginRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "twoFactorLoginRequest", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.ChallengeToken == "" || (req.Code == "") == (req.RecoveryCode == "") {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "challenge_token and exactly one of code or recovery_code are required"})
+		return
+	}
+
+	user, err := h.userStore.GetUserToken(tokens.ScopeTwoFactor, req.ChallengeToken)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getUserToken", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "challenge expired or invalid; please log in again"})
+		return
+	}
+
+	throttleKey := store.TwoFactorThrottleKey(user.ID)
+	lockedUntil, err := h.throttleStore.LockedUntil(throttleKey)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "lockedUntil", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if lockedUntil != nil {
+		writeTooManyAttempts(w, *lockedUntil)
+		return
+	}
+
+	ok, err := verifySecondFactor(h.twoFactorStore, user.ID, req.Code, req.RecoveryCode)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "verifySecondFactor", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !ok {
+		h.metrics.FailedLogins.Inc()
+		_, err = h.throttleStore.RecordFailure(throttleKey, h.userThrottle)
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "recordFailure", "error", err)
+		}
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid two-factor code"})
+		return
+	}
+
+	err = h.throttleStore.Reset(throttleKey)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "resetThrottle", "error", err)
+	}
+
+	err = h.tokenStore.DeleteAllTokensForUser(user.ID, tokens.ScopeTwoFactor)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "deleteTwoFactorChallenges", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if req.RecoveryCode != "" {
+		h.logger.WarnContext(r.Context(), "login completed with a recovery code", "user_id", user.ID)
+	}
+
+	h.issueTokenPair(w, r, user)
+}
+
+// @desc    Exchange a refresh token for a new token pair
+// @route   POST /api/authentication/refresh
+// @access  Public
+func (h *TokenHandler) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req refreshTokenRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "refreshTokenRequest", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.RefreshToken == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "refresh_token is required"})
+		return
+	}
+
+	access, refresh, err := h.tokenStore.RotateRefreshToken(req.RefreshToken, h.storedAccessTTL(), h.refreshTTL, clientInfo(r))
+	if err == store.ErrInvalidRefreshToken {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired refresh token"})
+		return
 	}
-	if user.AccountType == "admin" {
-		scope = "admin"
+
+	if err == store.ErrRefreshTokenReused {
+		h.logger.WarnContext(r.Context(), "refresh token reused; token family revoked")
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "refresh token has already been used; please log in again"})
+		return
 	}
 
-	token, err := h.tokenStore.CreateNewToken(user.ID, 24*time.Hour, scope)
 	if err != nil {
-		h.logger.Printf("ERROR: Creating Token: %v", err)
+		h.logger.ErrorContext(r.Context(), "rotateRefreshToken", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"auth_token": token})
+	if h.signer != nil {
+		// Signed tokens carry the user's role, so load it fresh: a refresh
+		// is when role changes reach signed tokens.
+		user, err := h.userStore.GetUserByID(refresh.UserID)
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "getUserByID", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+
+		if user == nil {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired refresh token"})
+			return
+		}
+
+		access, err = h.signAccessToken(user, refresh.FamilyID)
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "signAccessToken", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"auth_token": access, "refresh_token": refresh})
+}
+
+// recordFailure counts the attempt against both the address and the
+// username. The caller still answers "invalid credentials"; the lockout only
+// shows on the next attempt, so the response never hints at whether the
+// username exists.
+func (h *TokenHandler) recordFailure(r *http.Request, ipKey, userKey string) {
+	for key, policy := range map[string]store.ThrottlePolicy{ipKey: h.ipThrottle, userKey: h.userThrottle} {
+		lockedUntil, err := h.throttleStore.RecordFailure(key, policy)
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "recordFailure", "error", err)
+			continue
+		}
+		if lockedUntil != nil {
+			h.logger.WarnContext(r.Context(), "login throttled", "key", key, "locked_until", *lockedUntil)
+		}
+	}
 }
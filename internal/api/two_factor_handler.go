@@ -0,0 +1,292 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kevin120202/library-management-system/internal/middleware"
+	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/totp"
+	"github.com/kevin120202/library-management-system/internal/utils"
+)
+
+const recoveryCodeCount = 10
+
+type twoFactorCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type TwoFactorHandler struct {
+	twoFactorStore   store.TwoFactorStore
+	throttleStore    store.LoginThrottleStore
+	logger           *slog.Logger
+	issuer           string
+	requireForAdmins bool
+	codeThrottle     store.ThrottlePolicy
+}
+
+// NewTwoFactorHandler throttles code guesses with codeThrottle under the same
+// key as the two-factor login step, so guesses on every endpoint add up.
+func NewTwoFactorHandler(twoFactorStore store.TwoFactorStore, throttleStore store.LoginThrottleStore, logger *slog.Logger, issuer string, requireForAdmins bool, codeThrottle store.ThrottlePolicy) *TwoFactorHandler {
+	return &TwoFactorHandler{
+		twoFactorStore:   twoFactorStore,
+		throttleStore:    throttleStore,
+		logger:           logger,
+		issuer:           issuer,
+		requireForAdmins: requireForAdmins,
+		codeThrottle:     codeThrottle,
+	}
+}
+
+// codeLocked writes a 429 and reports true while userID is locked out of
+// entering two-factor codes.
+func (h *TwoFactorHandler) codeLocked(w http.ResponseWriter, r *http.Request, userID int) bool {
+	lockedUntil, err := h.throttleStore.LockedUntil(store.TwoFactorThrottleKey(userID))
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "lockedUntil", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return true
+	}
+
+	if lockedUntil != nil {
+		writeTooManyAttempts(w, *lockedUntil)
+		return true
+	}
+
+	return false
+}
+
+// recordCodeResult counts a wrong code towards the lockout and clears the
+// count after a right one.
+func (h *TwoFactorHandler) recordCodeResult(r *http.Request, userID int, ok bool) {
+	key := store.TwoFactorThrottleKey(userID)
+
+	var err error
+	if ok {
+		err = h.throttleStore.Reset(key)
+	} else {
+		_, err = h.throttleStore.RecordFailure(key, h.codeThrottle)
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "recordCodeResult", "error", err)
+	}
+}
+
+// checkTOTP accepts code if it is valid for secret and newer than the last
+// code the user entered.
+func checkTOTP(twoFactorStore store.TwoFactorStore, secret *store.TOTPSecret, code string) (bool, error) {
+	step, ok := totp.Validate(secret.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return twoFactorStore.RecordTOTPStep(secret.UserID, step)
+}
+
+// verifySecondFactor checks an authenticator code or, failing that, spends a
+// recovery code for a user with two-factor authentication enabled.
+func verifySecondFactor(twoFactorStore store.TwoFactorStore, userID int, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return twoFactorStore.UseRecoveryCode(userID, recoveryCode)
+	}
+
+	secret, err := twoFactorStore.GetTOTPSecret(userID)
+	if err != nil {
+		return false, err
+	}
+
+	if secret == nil || secret.EnabledAt == nil {
+		return false, nil
+	}
+
+	return checkTOTP(twoFactorStore, secret, code)
+}
+
+// generateRecoveryCodes returns codes of ten base32 characters, about 50 bits
+// each, grouped for reading as "abcde-fghij".
+func generateRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		text := strings.ToLower(rand.Text())
+		codes[i] = text[:5] + "-" + text[5:10]
+	}
+	return codes
+}
+
+// @desc    Start two-factor enrolment; returns the authenticator URI and recovery codes
+// @route   POST /api/users/me/2fa
+// @access  Private
+func (h *TwoFactorHandler) HandleEnroll(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	if currentUser.TwoFactorEnabled {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "generateSecret", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	recoveryCodes := generateRecoveryCodes()
+
+	err = h.twoFactorStore.BeginEnrollment(currentUser.ID, secret, recoveryCodes)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "beginEnrollment", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{
+		"otpauth_uri":    totp.URI(h.issuer, currentUser.Username, secret),
+		"secret":         secret,
+		"recovery_codes": recoveryCodes,
+	})
+}
+
+// @desc    Confirm two-factor enrolment with a code from the authenticator app
+// @route   POST /api/users/me/2fa/verify
+// @access  Private
+func (h *TwoFactorHandler) HandleVerify(w http.ResponseWriter, r *http.Request) {
+	var req twoFactorCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingVerifyTwoFactor", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	secret, err := h.twoFactorStore.GetTOTPSecret(currentUser.ID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getTOTPSecret", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if secret == nil {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "start two-factor enrolment first"})
+		return
+	}
+
+	if secret.EnabledAt != nil {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	if h.codeLocked(w, r, currentUser.ID) {
+		return
+	}
+
+	ok, err := checkTOTP(h.twoFactorStore, secret, req.Code)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "checkTOTP", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.recordCodeResult(r, currentUser.ID, ok)
+
+	if !ok {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid two-factor code"})
+		return
+	}
+
+	err = h.twoFactorStore.EnableTwoFactor(currentUser.ID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "enableTwoFactor", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"two_factor_enabled": true})
+}
+
+// @desc    Turn off two-factor authentication with a current code or recovery code
+// @route   DELETE /api/users/me/2fa
+// @access  Private
+func (h *TwoFactorHandler) HandleDisable(w http.ResponseWriter, r *http.Request) {
+	var req twoFactorCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingDisableTwoFactor", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	if !currentUser.TwoFactorEnabled {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "two-factor authentication is not enabled"})
+		return
+	}
+
+	if h.requireForAdmins && currentUser.IsAdmin() {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "two-factor authentication is mandatory for admin accounts"})
+		return
+	}
+
+	if h.codeLocked(w, r, currentUser.ID) {
+		return
+	}
+
+	ok, err := verifySecondFactor(h.twoFactorStore, currentUser.ID, req.Code, req.RecoveryCode)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "verifySecondFactor", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.recordCodeResult(r, currentUser.ID, ok)
+
+	if !ok {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid two-factor code"})
+		return
+	}
+
+	err = h.twoFactorStore.DisableTwoFactor(int64(currentUser.ID))
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "disableTwoFactor", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @desc    Reset a user's two-factor authentication, e.g. after a lost device
+// @route   DELETE /api/admin/users/{id}/2fa
+// @access  Private (perm:users:manage)
+func (h *TwoFactorHandler) HandleAdminResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.ReadIDParam(r)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid user id"})
+		return
+	}
+
+	err = h.twoFactorStore.DisableTwoFactor(userID)
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "disableTwoFactor", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "two-factor authentication reset", "target_user_id", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kevin120202/library-management-system/internal/middleware"
+	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/totp"
+)
+
+// fakeThrottleStore locks a key once it has failed limit times.
+type fakeThrottleStore struct {
+	store.LoginThrottleStore
+	limit    int
+	failures map[string]int
+}
+
+func (f *fakeThrottleStore) LockedUntil(keys ...string) (*time.Time, error) {
+	for _, key := range keys {
+		if f.failures[key] >= f.limit {
+			until := time.Now().Add(time.Minute)
+			return &until, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeThrottleStore) RecordFailure(key string, policy store.ThrottlePolicy) (*time.Time, error) {
+	f.failures[key]++
+	return nil, nil
+}
+
+func (f *fakeThrottleStore) Reset(key string) error {
+	delete(f.failures, key)
+	return nil
+}
+
+type fakeTwoFactorStore struct {
+	store.TwoFactorStore
+	secret   *store.TOTPSecret
+	lastStep int64
+	checks   int
+}
+
+func (f *fakeTwoFactorStore) GetTOTPSecret(userID int) (*store.TOTPSecret, error) {
+	return f.secret, nil
+}
+
+func (f *fakeTwoFactorStore) RecordTOTPStep(userID int, step int64) (bool, error) {
+	f.checks++
+	if step <= f.lastStep {
+		return false, nil
+	}
+	f.lastStep = step
+	return true, nil
+}
+
+func (f *fakeTwoFactorStore) UseRecoveryCode(userID int, code string) (bool, error) {
+	f.checks++
+	return false, nil
+}
+
+func (f *fakeTwoFactorStore) EnableTwoFactor(userID int) error {
+	return nil
+}
+
+func (f *fakeTwoFactorStore) DisableTwoFactor(userID int64) error {
+	return nil
+}
+
+func TestTwoFactorCodeGuessesAreThrottled(t *testing.T) {
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	enabled := time.Now()
+
+	tests := []struct {
+		name    string
+		secret  *store.TOTPSecret
+		enabled bool
+		handle  func(h *TwoFactorHandler) http.HandlerFunc
+	}{
+		{
+			name:   "verify enrolment",
+			secret: &store.TOTPSecret{UserID: 7, Secret: secret},
+			handle: func(h *TwoFactorHandler) http.HandlerFunc { return h.HandleVerify },
+		},
+		{
+			name:    "disable",
+			secret:  &store.TOTPSecret{UserID: 7, Secret: secret, EnabledAt: &enabled},
+			enabled: true,
+			handle:  func(h *TwoFactorHandler) http.HandlerFunc { return h.HandleDisable },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			twoFactorStore := &fakeTwoFactorStore{secret: tt.secret}
+			throttleStore := &fakeThrottleStore{limit: 3, failures: map[string]int{}}
+			h := NewTwoFactorHandler(twoFactorStore, throttleStore, discardLogger, "Library", false, store.ThrottlePolicy{})
+			user := &store.User{ID: 7, Username: "reader", TwoFactorEnabled: tt.enabled}
+
+			send := func(code string) int {
+				r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"code":"`+code+`"}`))
+				r = middleware.SetUser(r, user)
+				w := httptest.NewRecorder()
+				tt.handle(h)(w, r)
+				return w.Code
+			}
+
+			for i := range 3 {
+				if status := send("000000"); status != http.StatusBadRequest {
+					t.Fatalf("wrong guess %d: status = %d, want 400", i+1, status)
+				}
+			}
+
+			checksBefore := twoFactorStore.checks
+			code, err := totp.Code(secret, totp.Step(time.Now()))
+			if err != nil {
+				t.Fatalf("code: %v", err)
+			}
+
+			if status := send(code); status != http.StatusTooManyRequests {
+				t.Fatalf("right code while locked: status = %d, want 429", status)
+			}
+			if twoFactorStore.checks != checksBefore {
+				t.Fatal("code was checked while locked out")
+			}
+
+			delete(throttleStore.failures, store.TwoFactorThrottleKey(user.ID))
+			if status := send(code); status >= 400 {
+				t.Fatalf("right code after lockout: status = %d", status)
+			}
+			if throttleStore.failures[store.TwoFactorThrottleKey(user.ID)] != 0 {
+				t.Fatal("failure count not reset after a right code")
+			}
+		})
+	}
+}
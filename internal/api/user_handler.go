@@ -1,40 +1,140 @@
 package api
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/kevin120202/library-management-system/internal/mailer"
 	"github.com/kevin120202/library-management-system/internal/middleware"
 	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/tokens"
 	"github.com/kevin120202/library-management-system/internal/utils"
 )
 
 type registerUserRequest struct {
-	Username    string `json:"username"`
-	Email       string `json:"email"`
-	Address     string `json:"address"`
-	Password    string `json:"password"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Address  string `json:"address"`
+	Password string `json:"password"`
+}
+
+type adminCreateUserRequest struct {
+	registerUserRequest
+	AccountType string `json:"account_type"`
+}
+
+type updateUserRoleRequest struct {
 	AccountType string `json:"account_type"`
 }
 
+type activateUserRequest struct {
+	Token string `json:"token"`
+}
+
+type updateProfileRequest struct {
+	Email   *string `json:"email"`
+	Address *string `json:"address"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+var emailRegex = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+
+// activationResendThrottle lets a user ask for a few activation emails a day
+// before each further request has to wait, doubling up to an hour.
+var activationResendThrottle = store.ThrottlePolicy{
+	FreeFailures: 3,
+	BaseDelay:    time.Minute,
+	MaxDelay:     time.Hour,
+	Window:       24 * time.Hour,
+}
+
+// passwordCheckThrottle slows down guessing the current password through the
+// password change and account deletion endpoints with a stolen session.
+var passwordCheckThrottle = store.ThrottlePolicy{
+	FreeFailures: 5,
+	BaseDelay:    time.Minute,
+	MaxDelay:     time.Hour,
+	Window:       24 * time.Hour,
+}
+
 type UserHandler struct {
-	userStore  store.UserStore
-	tokenStore store.TokenStore
-	logger     *log.Logger
+	userStore     store.UserStore
+	tokenStore    store.TokenStore
+	throttleStore store.LoginThrottleStore
+	mailer        mailer.Mailer
+	logger        *slog.Logger
+	activationTTL time.Duration
+	pickupWindow  time.Duration
 }
 
-func NewUserHandler(userStore store.UserStore, tokenStore store.TokenStore, logger *log.Logger) *UserHandler {
+func NewUserHandler(userStore store.UserStore, tokenStore store.TokenStore, throttleStore store.LoginThrottleStore, mailer mailer.Mailer, logger *slog.Logger, activationTTL time.Duration, pickupWindow time.Duration) *UserHandler {
 	return &UserHandler{
-		userStore:  userStore,
-		tokenStore: tokenStore,
-		logger:     logger,
+		userStore:     userStore,
+		tokenStore:    tokenStore,
+		throttleStore: throttleStore,
+		mailer:        mailer,
+		logger:        logger,
+		activationTTL: activationTTL,
+		pickupWindow:  pickupWindow,
 	}
 }
 
+// sendActivation replaces any outstanding activation token for the user with
+// a fresh one and mails it.
+func (h *UserHandler) sendActivation(ctx context.Context, user *store.User) error {
+	err := h.tokenStore.DeleteAllTokensForUser(user.ID, tokens.ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	token, err := h.tokenStore.CreateNewToken(user.ID, h.activationTTL, tokens.ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	sendMailAsync(ctx, h.mailer, h.logger, mailer.Message{
+		To:      user.Email,
+		Subject: "Activate your library account",
+		Body: fmt.Sprintf(
+			"Hello %s,\n\nThanks for registering. To confirm this email address, send this token to PUT /api/users/activated:\n\n    %s\n\n"+
+				"It expires at %s. Until then you can log in and browse, but not borrow or place holds.\n",
+			user.Username, token.Plaintext, token.Expiry.UTC().Format(time.RFC1123),
+		),
+	})
+
+	return nil
+}
+
+// validatePassword applies the rules shared by registration and every
+// password change. bcrypt ignores anything past 72 bytes, so longer
+// passwords are refused rather than silently truncated.
+func validatePassword(password string) error {
+	if password == "" {
+		return errors.New("password is required")
+	}
+	if len(password) > 72 {
+		return errors.New("password cannot be longer than 72 bytes")
+	}
+	return nil
+}
+
 func (h *UserHandler) validateRegisterRequest(req *registerUserRequest) error {
 	if req.Username == "" {
 		return errors.New("username is required")
@@ -45,15 +145,11 @@ func (h *UserHandler) validateRegisterRequest(req *registerUserRequest) error {
 	if req.Email == "" {
 		return errors.New("email is required")
 	}
-	emailRegex := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
 	if !emailRegex.MatchString(req.Email) {
 		return errors.New("invalid email format")
 	}
-	if req.Password == "" {
-		return errors.New("password is required")
-	}
-	if strings.ToLower(req.AccountType) != "user" && strings.ToLower(req.AccountType) != "admin" {
-		return errors.New("enter valid account type")
+	if err := validatePassword(req.Password); err != nil {
+		return err
 	}
 	if req.Address == "" {
 		return errors.New("address is required")
@@ -69,7 +165,7 @@ func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request)
 	var req registerUserRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		h.logger.Printf("ERROR: decoding register request: %v", err)
+		h.logger.ErrorContext(r.Context(), "decoding register request", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
 		return
 	}
@@ -83,44 +179,620 @@ func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request)
 	user := &store.User{
 		Username:    req.Username,
 		Email:       req.Email,
-		AccountType: req.AccountType,
+		AccountType: "patron",
 		Address:     req.Address,
 	}
 
 	err = user.PasswordHash.Set(req.Password)
 	if err != nil {
-		h.logger.Printf("ERROR: hashing password: %v", err)
+		h.logger.ErrorContext(r.Context(), "hashing password", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
 	err = h.userStore.CreateUser(user)
+	if err == store.ErrDuplicateUser {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "username or email already taken"})
+		return
+	}
+
 	if err != nil {
-		h.logger.Printf("ERROR: registering user: %v", err)
+		h.logger.ErrorContext(r.Context(), "registering user", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "invalid request payload"})
 		return
 	}
 
+	// The account exists either way; if this fails the user can ask for
+	// another activation email.
+	err = h.sendActivation(r.Context(), user)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "sendActivation", "error", err)
+	}
+
 	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"user": user})
 }
 
-// @desc    Logout a user
+// @desc    Activate a user with the emailed token
+// @route   PUT /api/users/activated
+// @access  Public
+func (h *UserHandler) HandleActivateUser(w http.ResponseWriter, r *http.Request) {
+	var req activateUserRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decoding activate request", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Token == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "token is required"})
+		return
+	}
+
+	user, err := h.userStore.GetUserToken(tokens.ScopeActivation, req.Token)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getUserToken", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid or expired activation token"})
+		return
+	}
+
+	err = h.userStore.ActivateUser(user)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "activateUser", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+// @desc    Resend the activation email
+// @route   POST /api/users/me/activation
+// @access  Private
+func (h *UserHandler) HandleResendActivation(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	if currentUser.Activated {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "your account is already activated"})
+		return
+	}
+
+	key := "activation:" + strconv.Itoa(currentUser.ID)
+
+	lockedUntil, err := h.throttleStore.LockedUntil(key)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "lockedUntil", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if lockedUntil != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(time.Until(*lockedUntil).Seconds()), 1)))
+		utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{"error": "too many activation emails requested; try again later"})
+		return
+	}
+
+	_, err = h.throttleStore.RecordFailure(key, activationResendThrottle)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "recordResend", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.sendActivation(r.Context(), currentUser)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "sendActivation", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"message": "an activation email has been sent to " + currentUser.Email})
+}
+
+// confirmPassword reloads the current user and checks plaintext against
+// their password, throttling repeated misses. It writes the error response
+// itself and returns nil when the request should stop.
+func (h *UserHandler) confirmPassword(w http.ResponseWriter, r *http.Request, plaintext string) *store.User {
+	currentUser := middleware.GetUser(r)
+	key := "password:" + strconv.Itoa(currentUser.ID)
+
+	lockedUntil, err := h.throttleStore.LockedUntil(key)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "lockedUntil", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil
+	}
+
+	if lockedUntil != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(time.Until(*lockedUntil).Seconds()), 1)))
+		utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{"error": "too many incorrect passwords; try again later"})
+		return nil
+	}
+
+	user, err := h.userStore.GetUserByID(currentUser.ID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getUserByID", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "you must be logged in"})
+		return nil
+	}
+
+	ok, err := user.PasswordHash.Matches(plaintext)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "passwordMatches", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil
+	}
+
+	if !ok {
+		_, err = h.throttleStore.RecordFailure(key, passwordCheckThrottle)
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "recordFailure", "error", err)
+		}
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "current password is incorrect"})
+		return nil
+	}
+
+	err = h.throttleStore.Reset(key)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "resetThrottle", "error", err)
+	}
+
+	return user
+}
+
+// @desc    Get the current user's profile
+// @route   GET /api/users/me
+// @access  Private
+func (h *UserHandler) HandleGetMe(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	user, err := h.userStore.GetUserByID(currentUser.ID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getUserByID", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return
+	}
+
+	user.Permissions = currentUser.Permissions
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+// @desc    Update the current user's email or address; a new email must be verified again
+// @route   PATCH /api/users/me
+// @access  Private
+func (h *UserHandler) HandleUpdateMe(w http.ResponseWriter, r *http.Request) {
+	var req updateProfileRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingUpdateProfile", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Email == nil && req.Address == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "nothing to update"})
+		return
+	}
+
+	if req.Email != nil && !emailRegex.MatchString(*req.Email) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid email format"})
+		return
+	}
+
+	if req.Address != nil && *req.Address == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "address is required"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	user, err := h.userStore.GetUserByID(currentUser.ID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getUserByID", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return
+	}
+
+	oldEmail := user.Email
+	emailChanged := req.Email != nil && !strings.EqualFold(*req.Email, user.Email)
+
+	if req.Email != nil {
+		user.Email = *req.Email
+	}
+	if req.Address != nil {
+		user.Address = *req.Address
+	}
+	if emailChanged {
+		user.Activated = false
+	}
+
+	err = h.userStore.UpdateProfile(user)
+	if err == store.ErrDuplicateUser {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "email already taken"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "updateProfile", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if emailChanged {
+		// A reset link mailed to the old address must not outlive the change.
+		err = h.tokenStore.DeleteAllTokensForUser(user.ID, tokens.ScopePasswordReset)
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "deleteResetTokens", "error", err)
+		}
+
+		sendMailAsync(r.Context(), h.mailer, h.logger, mailer.Message{
+			To:      oldEmail,
+			Subject: "Your library account email was changed",
+			Body: fmt.Sprintf(
+				"Hello %s,\n\nThe email address on your library account was changed to %s. If you did not do this, contact the library.\n",
+				user.Username, user.Email,
+			),
+		})
+
+		err = h.sendActivation(r.Context(), user)
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "sendActivation", "error", err)
+		}
+	}
+
+	user.Permissions = currentUser.Permissions
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+// @desc    Change the current user's password; every session is signed out
+// @route   PUT /api/users/me/password
+// @access  Private
+func (h *UserHandler) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req changePasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingChangePassword", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.CurrentPassword == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "current_password is required"})
+		return
+	}
+
+	err = validatePassword(req.NewPassword)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	user := h.confirmPassword(w, r, req.CurrentPassword)
+	if user == nil {
+		return
+	}
+
+	err = user.PasswordHash.Set(req.NewPassword)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "hashing password", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.userStore.UpdatePassword(user)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "updatePassword", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	sendMailAsync(r.Context(), h.mailer, h.logger, mailer.Message{
+		To:      user.Email,
+		Subject: "Your library account password was changed",
+		Body: fmt.Sprintf(
+			"Hello %s,\n\nYour password was changed and every session was signed out. If you did not do this, reset your password at once.\n",
+			user.Username,
+		),
+	})
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "your password was changed; please log in again"})
+}
+
+// @desc    Close the current user's account, keeping anonymized loan history
+// @route   DELETE /api/users/me
+// @access  Private
+func (h *UserHandler) HandleDeleteMe(w http.ResponseWriter, r *http.Request) {
+	var req deleteAccountRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decodingDeleteAccount", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Password == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "password is required"})
+		return
+	}
+
+	if middleware.GetUser(r).IsAdmin() {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "admin accounts cannot be deleted; have another admin change your role first"})
+		return
+	}
+
+	user := h.confirmPassword(w, r, req.Password)
+	if user == nil {
+		return
+	}
+
+	err = h.userStore.AnonymizeUser(user.ID, h.pickupWindow)
+	if err == store.ErrActiveLoans {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "return every borrowed item before deleting your account"})
+		return
+	}
+
+	if err == store.ErrUnpaidBalance {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "pay your outstanding fines before deleting your account"})
+		return
+	}
+
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "anonymizeUser", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "account deleted by user", "user_id", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @desc    Logout a user; ?everywhere=true ends every session, not just this one
 // @route   POST /api/logout
 // @access  Private
 func (h *UserHandler) HandleLogoutUser(w http.ResponseWriter, r *http.Request) {
 	currentUser := middleware.GetUser(r)
 
-	if currentUser == nil || currentUser == store.AnonymousUser {
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "you must be logged in"})
+	if r.URL.Query().Get("everywhere") != "true" {
+		var err error
+		if claims := middleware.GetAccessClaims(r); claims != nil {
+			_, err = h.tokenStore.DeleteSession(currentUser.ID, claims.SessionID)
+		} else {
+			err = h.tokenStore.DeleteSessionForToken(middleware.GetToken(r))
+		}
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "HandleLogoutUser", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to logout"})
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusOK, utils.Envelope{"Logout": true})
 		return
 	}
 
-	err := h.tokenStore.DeleteAllTokensForUser(currentUser.ID, currentUser.AccountType)
+	err := h.tokenStore.RevokeAllSessions(currentUser.ID)
 	if err != nil {
-		h.logger.Printf("ERROR: HandleLogoutUser: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to lougout"})
+		h.logger.ErrorContext(r.Context(), "HandleLogoutUser", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to logout"})
 		return
 	}
 
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"Logout": true})
 }
+
+// @desc    Create a user with any role
+// @route   POST /api/admin/users
+// @access  Private (users:manage)
+func (h *UserHandler) HandleAdminCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req adminCreateUserRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decoding admin create user request", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	err = h.validateRegisterRequest(&req.registerUserRequest)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	if req.AccountType == "" {
+		req.AccountType = "patron"
+	}
+
+	user := &store.User{
+		Username:    req.Username,
+		Email:       req.Email,
+		AccountType: strings.ToLower(req.AccountType),
+		Address:     req.Address,
+		Activated:   true,
+	}
+
+	err = user.PasswordHash.Set(req.Password)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "hashing password", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.userStore.CreateUser(user)
+	if err == store.ErrDuplicateUser {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "username or email already taken"})
+		return
+	}
+
+	if err == store.ErrUnknownRole {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown account type"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "admin creating user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"user": user})
+}
+
+// @desc    Change a user's role
+// @route   PATCH /api/admin/users/{id}/role
+// @access  Private (users:manage)
+func (h *UserHandler) HandleUpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.ReadIDParam(r)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid user id"})
+		return
+	}
+
+	var req updateUserRoleRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "decoding update role request", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.AccountType == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "account_type is required"})
+		return
+	}
+
+	// Stops the last administrator from locking everyone out by demoting themselves.
+	currentUser := middleware.GetUser(r)
+	if int64(currentUser.ID) == userID {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "you cannot change your own role"})
+		return
+	}
+
+	user, err := h.userStore.UpdateUserRole(userID, strings.ToLower(req.AccountType))
+	if err == store.ErrUnknownRole {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown account type"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "updateUserRole", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+// @desc    List users
+// @route   GET /api/admin/users?limit=&cursor=&sort=&order=&account_type=
+// @access  Private (users:manage)
+func (h *UserHandler) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	listParams, err := readListParams(r, []string{"username", "created_at"}, "username")
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	params := store.UserListParams{
+		ListParams:  listParams,
+		AccountType: strings.ToLower(r.URL.Query().Get("account_type")),
+	}
+
+	page, err := h.userStore.ListUsers(params)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "listUsers", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, pageEnvelope("users", page))
+}
+
+// @desc    Clear a user's login lockout
+// @route   DELETE /api/admin/users/{id}/lockout
+// @access  Private (users:manage)
+func (h *UserHandler) HandleUnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.ReadIDParam(r)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid user id"})
+		return
+	}
+
+	err = h.throttleStore.UnlockUser(userID)
+	if err == sql.ErrNoRows {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "unlockUser", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @desc    Log a user out everywhere, including signed access tokens
+// @route   DELETE /api/admin/users/{id}/sessions
+// @access  Private (users:manage)
+func (h *UserHandler) HandleRevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.ReadIDParam(r)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "readIDParam", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid user id"})
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(int(userID))
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "getUserByID", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return
+	}
+
+	err = h.tokenStore.RevokeAllSessions(user.ID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "revokeAllSessions", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.logger.WarnContext(r.Context(), "all sessions revoked by admin", "target_user_id", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
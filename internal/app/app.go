@@ -1,62 +1,334 @@
 package app
 
 import (
+	"crypto/ed25519"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
-	"net/http"
+	"log/slog"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/kevin120202/library-management-system/internal/api"
+	"github.com/kevin120202/library-management-system/internal/config"
+	"github.com/kevin120202/library-management-system/internal/logging"
+	"github.com/kevin120202/library-management-system/internal/mailer"
+	"github.com/kevin120202/library-management-system/internal/metrics"
 	"github.com/kevin120202/library-management-system/internal/middleware"
+	"github.com/kevin120202/library-management-system/internal/scheduler"
+	"github.com/kevin120202/library-management-system/internal/sso"
 	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/tokens"
 	"github.com/kevin120202/library-management-system/migrations"
 )
 
 type Application struct {
-	Logger       *log.Logger
-	UserHandler  *api.UserHandler
-	TokenHandler *api.TokenHandler
-	Middleware   middleware.UserMiddleware
-	BookHandler  *api.BookHandler
-	DB           *sql.DB
+	Config               *config.Config
+	Logger               *slog.Logger
+	UserHandler          *api.UserHandler
+	PasswordResetHandler *api.PasswordResetHandler
+	SessionHandler       *api.SessionHandler
+	TwoFactorHandler     *api.TwoFactorHandler
+	APIKeyHandler        *api.APIKeyHandler
+	TokenHandler         *api.TokenHandler
+	Middleware           middleware.UserMiddleware
+	BookHandler          *api.BookHandler
+	BorrowReturnHandler  *api.BorrowReturnHandler
+	ItemHandler          *api.ItemHandler
+	HoldHandler          *api.HoldHandler
+	FineHandler          *api.FineHandler
+	JobHandler           *api.JobHandler
+	RoleHandler          *api.RoleHandler
+	HealthHandler        *api.HealthHandler
+	Metrics              *metrics.Metrics
+	Scheduler            *scheduler.Scheduler
+	DB                   *sql.DB
+
+	// OIDCHandler is nil unless single sign-on is configured.
+	OIDCHandler *api.OIDCHandler
+
+	stopRevocationRefresh chan struct{}
 }
 
-func NewApplication() (*Application, error) {
-	pgDB, err := store.Open()
+func NewApplication(cfg *config.Config) (*Application, error) {
+	logger := logging.New(os.Stdout, cfg.LogLevel)
+	slog.SetDefault(logger)
+
+	pgDB, err := store.Open(cfg.DB.DSN)
 	if err != nil {
 		return nil, err
 	}
+	logger.Info("connected to database")
+	pgDB.SetMaxOpenConns(cfg.DB.MaxOpenConns)
+	pgDB.SetMaxIdleConns(cfg.DB.MaxIdleConns)
+	pgDB.SetConnMaxLifetime(cfg.DB.ConnMaxLifetime)
 
 	err = store.MigrateFS(pgDB, migrations.FS, ".")
 	if err != nil {
 		panic(err)
 	}
 
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
-
 	userStore := store.NewPostgresUserStore(pgDB)
 	tokenStore := store.NewPostgresTokenStore(pgDB)
 	bookStore := store.NewPostgresBookStore(pgDB)
+	borrowReturnStore := store.NewPostgresBorrowReturnStore(pgDB)
+	itemStore := store.NewPostgresItemStore(pgDB)
+	holdStore := store.NewPostgresHoldStore(pgDB)
+	fineStore := store.NewPostgresFineStore(pgDB)
+	permissionStore := store.NewPostgresPermissionStore(pgDB)
+	throttleStore := store.NewPostgresLoginThrottleStore(pgDB)
+	apiKeyStore := store.NewPostgresAPIKeyStore(pgDB)
+	oidcStore := store.NewPostgresOIDCStore(pgDB)
+	twoFactorStore := store.NewPostgresTwoFactorStore(pgDB)
 
-	userHandler := api.NewUserHandler(userStore, tokenStore, logger)
-	tokenHandler := api.NewTokenHandler(tokenStore, userStore, logger)
-	bookHandler := api.NewBookHandler(bookStore, logger)
+	err = fineStore.SetDailyRates(cfg.Fines.DailyRatesCents)
+	if err != nil {
+		return nil, fmt.Errorf("fine rates: %w", err)
+	}
+
+	var outbox mailer.Mailer
+	switch cfg.Mail.Driver {
+	case "smtp":
+		outbox = mailer.NewSMTPMailer(cfg.Mail.SMTPHost, cfg.Mail.SMTPPort, cfg.Mail.SMTPUsername, cfg.Mail.SMTPPassword, cfg.Mail.From)
+	case "file":
+		outbox = mailer.NewFileMailer(cfg.Mail.FileDir, cfg.Mail.From, logger)
+	default:
+		outbox = mailer.NewLogMailer(logger)
+	}
 
-	middlewareHandler := middleware.UserMiddleware{UserStore: userStore}
+	userHandler := api.NewUserHandler(userStore, tokenStore, throttleStore, outbox, logger, cfg.Tokens.ActivationTTL, cfg.Loans.HoldPickupWindow)
+	appMetrics := metrics.New(pgDB, func() (int64, error) {
+		return tokenStore.CountActiveTokens(tokens.ScopeAuth)
+	}, logger)
+
+	userThrottle := store.ThrottlePolicy{
+		FreeFailures: cfg.Login.UserMaxFailures,
+		BaseDelay:    cfg.Login.UserLockout,
+		MaxDelay:     cfg.Login.MaxLockout,
+		Window:       cfg.Login.FailureWindow,
+	}
+	tokenHandler := api.NewTokenHandler(tokenStore, userStore, throttleStore, twoFactorStore, logger, cfg.Tokens.AuthTTL, cfg.Tokens.RefreshTTL, appMetrics,
+		userThrottle,
+		store.ThrottlePolicy{
+			FreeFailures: cfg.Login.IPMaxFailures,
+			BaseDelay:    cfg.Login.IPBackoff,
+			MaxDelay:     cfg.Login.MaxLockout,
+			Window:       cfg.Login.FailureWindow,
+		},
+		api.TwoFactorPolicy{
+			ChallengeTTL:     cfg.TwoFactor.ChallengeTTL,
+			RequireForAdmins: cfg.TwoFactor.RequireForAdmins,
+		},
+	)
+	middlewareHandler := middleware.UserMiddleware{UserStore: userStore, PermissionStore: permissionStore, TokenStore: tokenStore, APIKeyStore: apiKeyStore, Logger: logger, RequireAdminTwoFactor: cfg.TwoFactor.RequireForAdmins}
+
+	stopRevocationRefresh := make(chan struct{})
+	if cfg.Tokens.Strategy == "signed" {
+		signer, revocations, err := newSigner(cfg, tokenStore)
+		if err != nil {
+			return nil, err
+		}
+		tokenHandler.UseSignedAccessTokens(signer, permissionStore)
+		middlewareHandler.Signer = signer
+		middlewareHandler.Revocations = revocations
+		go refreshRevocations(revocations, tokenStore, cfg.Tokens.AuthTTL, cfg.Tokens.RevocationRefresh, logger, stopRevocationRefresh)
+	}
+
+	twoFactorHandler := api.NewTwoFactorHandler(twoFactorStore, throttleStore, logger, cfg.TwoFactor.Issuer, cfg.TwoFactor.RequireForAdmins, userThrottle)
+	sessionHandler := api.NewSessionHandler(tokenStore, logger)
+	apiKeyHandler := api.NewAPIKeyHandler(apiKeyStore, logger)
+
+	var oidcHandler *api.OIDCHandler
+	if cfg.OIDC.Enabled() {
+		ssoClient := sso.New(sso.Config{
+			IssuerURL:    cfg.OIDC.IssuerURL,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.OIDC.RedirectURL,
+			Scopes:       strings.Fields(cfg.OIDC.Scopes),
+			GroupsClaim:  cfg.OIDC.GroupsClaim,
+		})
+		oidcHandler = api.NewOIDCHandler(ssoClient, oidcStore, userStore, permissionStore, tokenHandler, logger, api.OIDCPolicy{
+			GroupRoles:         cfg.OIDC.GroupRoles,
+			DefaultAccountType: cfg.OIDC.DefaultAccountType,
+			AutoProvision:      cfg.OIDC.AutoProvision,
+			SyncRoles:          cfg.OIDC.SyncRoles,
+			StateTTL:           cfg.OIDC.StateTTL,
+			SecureCookie:       strings.HasPrefix(cfg.OIDC.RedirectURL, "https://"),
+		})
+	}
+	passwordResetHandler := api.NewPasswordResetHandler(userStore, tokenStore, outbox, logger, cfg.Tokens.PasswordResetTTL)
+	bookHandler := api.NewBookHandler(bookStore, fineStore, logger, cfg.Loans.Period, cfg.Fines.MaxBalanceCents, appMetrics)
+	borrowReturnHandler := api.NewBorrowReturnHandler(borrowReturnStore, logger, cfg.Loans.Period, cfg.Loans.MaxRenewals, cfg.Loans.HoldPickupWindow, appMetrics)
+	itemHandler := api.NewItemHandler(itemStore, bookStore, logger)
+	holdHandler := api.NewHoldHandler(holdStore, logger, cfg.Loans.HoldPickupWindow)
+	fineHandler := api.NewFineHandler(fineStore, logger)
+	roleHandler := api.NewRoleHandler(permissionStore, logger)
+
+	jobs := scheduler.New(pgDB, logger)
+	jobs.Register("purge-expired-tokens", cfg.Jobs.TokenPurgeInterval, tokenStore.DeleteExpiredTokens)
+	jobs.Register("mark-overdue-loans", cfg.Jobs.OverdueScanInterval, func() (int64, error) {
+		marked, err := borrowReturnStore.MarkOverdueLoans()
+		appMetrics.LoansMarkedOverdue.Add(float64(marked))
+		return marked, err
+	})
+	jobs.Register("accrue-overdue-fines", cfg.Jobs.FineAccrualInterval, fineStore.AccrueOverdueFines)
+	jobs.Register("expire-stale-holds", cfg.Jobs.HoldExpiryInterval, func() (int64, error) {
+		return holdStore.ExpireStaleHolds(cfg.Loans.HoldPickupWindow)
+	})
+	jobs.Register("purge-token-revocations", cfg.Jobs.TokenPurgeInterval, func() (int64, error) {
+		return tokenStore.DeleteStaleRevocations(cfg.Tokens.AuthTTL)
+	})
+	jobs.Register("purge-oidc-login-states", cfg.Jobs.TokenPurgeInterval, oidcStore.DeleteExpiredLoginStates)
+	jobs.Register("purge-login-throttles", cfg.Jobs.ThrottlePurgeInterval, func() (int64, error) {
+		return throttleStore.DeleteStaleThrottles(cfg.Login.FailureWindow)
+	})
+	jobs.Start()
+
+	jobHandler := api.NewJobHandler(jobs, logger)
+	healthHandler := api.NewHealthHandler(pgDB, migrations.FS, jobs, logger)
 
 	app := &Application{
-		Logger:       logger,
-		UserHandler:  userHandler,
-		TokenHandler: tokenHandler,
-		Middleware:   middlewareHandler,
-		BookHandler:  bookHandler,
-		DB:           pgDB,
+		Config:               cfg,
+		Logger:               logger,
+		UserHandler:          userHandler,
+		PasswordResetHandler: passwordResetHandler,
+		SessionHandler:       sessionHandler,
+		TwoFactorHandler:     twoFactorHandler,
+		APIKeyHandler:        apiKeyHandler,
+		OIDCHandler:          oidcHandler,
+		TokenHandler:         tokenHandler,
+		Middleware:           middlewareHandler,
+		BookHandler:          bookHandler,
+		BorrowReturnHandler:  borrowReturnHandler,
+		ItemHandler:          itemHandler,
+		HoldHandler:          holdHandler,
+		FineHandler:          fineHandler,
+		JobHandler:           jobHandler,
+		RoleHandler:          roleHandler,
+		HealthHandler:        healthHandler,
+		Metrics:              appMetrics,
+		Scheduler:            jobs,
+		DB:                   pgDB,
+
+		stopRevocationRefresh: stopRevocationRefresh,
 	}
 
 	return app, nil
 }
 
-func (a *Application) HealthCheck(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Status is available\n")
+// newSigner builds the access token signer from the configured keys and
+// loads the revocation list it is checked against.
+func newSigner(cfg *config.Config, tokenStore store.TokenStore) (*tokens.Signer, *tokens.RevocationList, error) {
+	keys := map[string]ed25519.PrivateKey{}
+	for id, seed := range cfg.Tokens.SigningKeys {
+		key, err := tokens.ParseSigningKey(seed)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tokens.signing_keys.%s: %w", id, err)
+		}
+		keys[id] = key
+	}
+
+	signer, err := tokens.NewSigner(cfg.Tokens.SigningKeyID, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	loaded, err := tokenStore.LoadRevocations(cfg.Tokens.AuthTTL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load token revocations: %w", err)
+	}
+
+	revocations := tokens.NewRevocationList()
+	revocations.Replace(loaded)
+
+	return signer, revocations, nil
+}
+
+// refreshRevocations reloads the revocation list until stop is closed. It
+// runs on every replica, unlike scheduler jobs, since each keeps its own copy.
+func refreshRevocations(revocations *tokens.RevocationList, tokenStore store.TokenStore, maxAge, interval time.Duration, logger *slog.Logger, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			loaded, err := tokenStore.LoadRevocations(maxAge)
+			if err != nil {
+				logger.Error("reload token revocations", "error", err)
+				continue
+			}
+			revocations.Replace(loaded)
+		}
+	}
+}
+
+// BootstrapAdmin creates the first administrator account. It does nothing
+// when the username already exists, so the flag can stay in a deployment's
+// start command without resetting anyone's password.
+func (a *Application) BootstrapAdmin(username, email, password, address string) error {
+	if username == "" || email == "" || password == "" {
+		return errors.New("bootstrap admin: username, email and password are required")
+	}
+
+	userStore := store.NewPostgresUserStore(a.DB)
+
+	existing, err := userStore.GetUserByUsername(username)
+	if err != nil {
+		return fmt.Errorf("bootstrap admin: %w", err)
+	}
+
+	if existing != nil {
+		a.Logger.Info("bootstrap admin: user already exists, skipping", "username", username)
+		return nil
+	}
+
+	admin := &store.User{
+		Username:    username,
+		Email:       email,
+		AccountType: "admin",
+		Address:     address,
+		Activated:   true,
+	}
+
+	err = admin.PasswordHash.Set(password)
+	if err != nil {
+		return fmt.Errorf("bootstrap admin: %w", err)
+	}
+
+	err = userStore.CreateUser(admin)
+	if err != nil {
+		return fmt.Errorf("bootstrap admin: %w", err)
+	}
+
+	a.Logger.Info("bootstrap admin: created administrator", "username", username)
+	return nil
+}
+
+// StartDraining makes the readiness check report "draining" so load
+// balancers stop sending new traffic while in-flight requests finish.
+func (a *Application) StartDraining() {
+	a.HealthHandler.StartDraining()
+}
+
+// Close stops the background jobs, flushes the log and releases the database
+// pool. It must only be called once the HTTP server has shut down.
+func (a *Application) Close() error {
+	close(a.stopRevocationRefresh)
+	a.Scheduler.Stop()
+	a.Logger.Info("background jobs stopped")
+
+	err := a.DB.Close()
+	if err != nil {
+		return fmt.Errorf("close db: %w", err)
+	}
+	a.Logger.Info("database pool closed")
+
+	// Stdout may be a pipe or terminal that cannot be synced; that is fine.
+	_ = os.Stdout.Sync()
+	return nil
 }
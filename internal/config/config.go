@@ -0,0 +1,321 @@
+// Package config holds every tunable of the server in one typed struct.
+//
+// Settings are resolved in increasing order of precedence:
+//
+//  1. built-in defaults (see Default)
+//  2. a YAML or TOML file given by -config or LIBRARY_CONFIG
+//  3. environment variables, LIBRARY_ followed by the upper-cased key with
+//     dots replaced by underscores (db.max_open_conns -> LIBRARY_DB_MAX_OPEN_CONNS)
+//  4. command-line flags, the key with dots and underscores replaced by
+//     dashes (db.max_open_conns -> -db-max-open-conns)
+//
+// Durations accept Go syntax ("90m", "24h") plus whole days ("14d").
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Port     int
+	LogLevel string
+
+	// DrainDelay is how long /api/health reports "draining" before the
+	// server stops accepting connections, giving load balancers time to
+	// notice. ShutdownTimeout bounds how long in-flight requests may run
+	// after that.
+	DrainDelay      time.Duration
+	ShutdownTimeout time.Duration
+
+	DB        DBConfig
+	Tokens    TokenConfig
+	Login     LoginConfig
+	Loans     LoanConfig
+	Fines     FineConfig
+	Jobs      JobConfig
+	Metrics   MetricsConfig
+	Mail      MailConfig
+	OIDC      OIDCConfig
+	TwoFactor TwoFactorConfig
+}
+
+type DBConfig struct {
+	DSN             string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// TokenConfig sets token lifetimes. AuthTTL is the short-lived access token;
+// clients renew it with a refresh token, which lasts RefreshTTL from its
+// last use.
+//
+// Strategy "opaque" stores access tokens in the database and looks them up
+// on every request. "signed" issues Ed25519-signed JWTs instead, checked
+// without a query: SigningKeys maps key IDs to base64 seeds, SigningKeyID
+// picks the one new tokens are signed with, and every replica reloads the
+// revocation list each RevocationRefresh.
+type TokenConfig struct {
+	AuthTTL           time.Duration
+	RefreshTTL        time.Duration
+	PasswordResetTTL  time.Duration
+	ActivationTTL     time.Duration
+	Strategy          string
+	SigningKeyID      string
+	SigningKeys       map[string]string
+	RevocationRefresh time.Duration
+}
+
+// LoginConfig throttles password guessing. Failures are counted per
+// username and per client address; past the free allowance each failure
+// locks the subject out, starting at the base duration and doubling up to
+// MaxLockout. Counts restart after FailureWindow without failures.
+type LoginConfig struct {
+	UserMaxFailures int
+	UserLockout     time.Duration
+	IPMaxFailures   int
+	IPBackoff       time.Duration
+	MaxLockout      time.Duration
+	FailureWindow   time.Duration
+}
+
+type LoanConfig struct {
+	Period           time.Duration
+	MaxRenewals      int
+	HoldPickupWindow time.Duration
+}
+
+type FineConfig struct {
+	// MaxBalanceCents is the outstanding balance above which borrowing is refused.
+	MaxBalanceCents int
+	// DailyRatesCents overrides the per-category daily rate stored in the
+	// database; categories not listed keep their current rate.
+	DailyRatesCents map[string]int
+}
+
+type JobConfig struct {
+	TokenPurgeInterval    time.Duration
+	OverdueScanInterval   time.Duration
+	FineAccrualInterval   time.Duration
+	HoldExpiryInterval    time.Duration
+	ThrottlePurgeInterval time.Duration
+}
+
+type MetricsConfig struct {
+	// Token, when set, must be presented as a bearer token to read /metrics.
+	Token string
+}
+
+// MailConfig picks the outbound mailer: "smtp" for real delivery, "file" to
+// write .eml files to FileDir, or "log" to print messages to the log.
+type MailConfig struct {
+	Driver       string
+	From         string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	FileDir      string
+}
+
+// OIDCConfig enables single sign-on through an OpenID Connect provider when
+// IssuerURL is set. GroupRoles maps provider groups to account types; a user
+// in several mapped groups gets the role with the most permissions. The
+// mapping only sets the role of newly provisioned accounts, falling back to
+// DefaultAccountType, unless SyncRoles also applies it to existing accounts
+// in a mapped group at every sign-in.
+type OIDCConfig struct {
+	IssuerURL          string
+	ClientID           string
+	ClientSecret       string
+	RedirectURL        string
+	Scopes             string
+	GroupsClaim        string
+	GroupRoles         map[string]string
+	DefaultAccountType string
+	AutoProvision      bool
+	SyncRoles          bool
+	StateTTL           time.Duration
+}
+
+// TwoFactorConfig controls TOTP two-factor authentication. Issuer is the
+// account label shown in authenticator apps; ChallengeTTL is how long a user
+// has to enter a code after their password. With RequireForAdmins, admins
+// who have not enrolled can do nothing but enrol.
+type TwoFactorConfig struct {
+	Issuer           string
+	ChallengeTTL     time.Duration
+	RequireForAdmins bool
+}
+
+func (c OIDCConfig) Enabled() bool {
+	return c.IssuerURL != ""
+}
+
+func Default() *Config {
+	return &Config{
+		Port:            8080,
+		LogLevel:        "info",
+		DrainDelay:      5 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		DB: DBConfig{
+			DSN:             "host=localhost user=postgres password=postgres dbname=postgres port=5434 sslmode=disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    25,
+			ConnMaxLifetime: 15 * time.Minute,
+		},
+		Tokens: TokenConfig{
+			AuthTTL:           15 * time.Minute,
+			RefreshTTL:        30 * 24 * time.Hour,
+			PasswordResetTTL:  45 * time.Minute,
+			ActivationTTL:     3 * 24 * time.Hour,
+			Strategy:          "opaque",
+			SigningKeys:       map[string]string{},
+			RevocationRefresh: 15 * time.Second,
+		},
+		Login: LoginConfig{
+			UserMaxFailures: 5,
+			UserLockout:     15 * time.Minute,
+			IPMaxFailures:   20,
+			IPBackoff:       time.Second,
+			MaxLockout:      24 * time.Hour,
+			FailureWindow:   time.Hour,
+		},
+		Loans: LoanConfig{
+			Period:           14 * 24 * time.Hour,
+			MaxRenewals:      2,
+			HoldPickupWindow: 3 * 24 * time.Hour,
+		},
+		Fines: FineConfig{
+			MaxBalanceCents: 1000,
+			DailyRatesCents: map[string]int{},
+		},
+		Mail: MailConfig{
+			Driver:   "log",
+			From:     "Library <library@localhost>",
+			SMTPPort: 587,
+			FileDir:  "mail",
+		},
+		OIDC: OIDCConfig{
+			Scopes:             "email profile",
+			GroupsClaim:        "groups",
+			GroupRoles:         map[string]string{},
+			DefaultAccountType: "patron",
+			AutoProvision:      true,
+			StateTTL:           10 * time.Minute,
+		},
+		TwoFactor: TwoFactorConfig{
+			Issuer:       "Library",
+			ChallengeTTL: 5 * time.Minute,
+		},
+		Jobs: JobConfig{
+			TokenPurgeInterval:    time.Hour,
+			OverdueScanInterval:   15 * time.Minute,
+			FineAccrualInterval:   time.Hour,
+			HoldExpiryInterval:    5 * time.Minute,
+			ThrottlePurgeInterval: time.Hour,
+		},
+	}
+}
+
+// Validate reports every invalid setting at once rather than stopping at the
+// first, so a broken deployment can be fixed in one go.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Port > 0 && c.Port < 65536, "port must be between 1 and 65535, got %d", c.Port)
+	check(c.LogLevel == "debug" || c.LogLevel == "info" || c.LogLevel == "warn" || c.LogLevel == "error",
+		"log_level must be one of debug, info, warn, error, got %q", c.LogLevel)
+	check(c.DrainDelay >= 0, "drain_delay cannot be negative")
+	check(c.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+
+	check(c.DB.DSN != "", "db.dsn is required")
+	check(c.DB.MaxOpenConns > 0, "db.max_open_conns must be positive, got %d", c.DB.MaxOpenConns)
+	check(c.DB.MaxIdleConns >= 0, "db.max_idle_conns cannot be negative, got %d", c.DB.MaxIdleConns)
+	check(c.DB.MaxIdleConns <= c.DB.MaxOpenConns, "db.max_idle_conns (%d) cannot exceed db.max_open_conns (%d)", c.DB.MaxIdleConns, c.DB.MaxOpenConns)
+	check(c.DB.ConnMaxLifetime >= 0, "db.conn_max_lifetime cannot be negative")
+
+	check(c.Tokens.AuthTTL > 0, "tokens.auth_ttl must be positive")
+	check(c.Tokens.RefreshTTL > c.Tokens.AuthTTL, "tokens.refresh_ttl must be longer than tokens.auth_ttl")
+	check(c.Tokens.PasswordResetTTL > 0, "tokens.password_reset_ttl must be positive")
+	check(c.Tokens.ActivationTTL > 0, "tokens.activation_ttl must be positive")
+	switch c.Tokens.Strategy {
+	case "signed":
+		_, ok := c.Tokens.SigningKeys[c.Tokens.SigningKeyID]
+		check(ok, "tokens.signing_key_id %q must name one of tokens.signing_keys", c.Tokens.SigningKeyID)
+		for id, seed := range c.Tokens.SigningKeys {
+			raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(seed))
+			check(err == nil && len(raw) == ed25519.SeedSize, "tokens.signing_keys.%s must be %d base64-encoded bytes", id, ed25519.SeedSize)
+		}
+		check(c.Tokens.RevocationRefresh > 0, "tokens.revocation_refresh must be positive")
+	case "opaque":
+	default:
+		check(false, "tokens.strategy must be one of opaque, signed, got %q", c.Tokens.Strategy)
+	}
+
+	check(c.Login.UserMaxFailures >= 0, "login.user_max_failures cannot be negative, got %d", c.Login.UserMaxFailures)
+	check(c.Login.UserLockout > 0, "login.user_lockout must be positive")
+	check(c.Login.IPMaxFailures >= 0, "login.ip_max_failures cannot be negative, got %d", c.Login.IPMaxFailures)
+	check(c.Login.IPBackoff > 0, "login.ip_backoff must be positive")
+	check(c.Login.MaxLockout >= c.Login.UserLockout && c.Login.MaxLockout >= c.Login.IPBackoff,
+		"login.max_lockout must be at least login.user_lockout and login.ip_backoff")
+	check(c.Login.FailureWindow > 0, "login.failure_window must be positive")
+
+	check(c.Loans.Period > 0, "loans.period must be positive")
+	check(c.Loans.MaxRenewals >= 0, "loans.max_renewals cannot be negative, got %d", c.Loans.MaxRenewals)
+	check(c.Loans.HoldPickupWindow > 0, "loans.hold_pickup_window must be positive")
+
+	check(c.Fines.MaxBalanceCents >= 0, "fines.max_balance_cents cannot be negative, got %d", c.Fines.MaxBalanceCents)
+	for category, rate := range c.Fines.DailyRatesCents {
+		check(category != "", "fines.daily_rates_cents has an empty category")
+		check(rate >= 0, "fines.daily_rates_cents.%s cannot be negative, got %d", category, rate)
+	}
+
+	check(c.Jobs.TokenPurgeInterval > 0, "jobs.token_purge_interval must be positive")
+	check(c.Jobs.OverdueScanInterval > 0, "jobs.overdue_scan_interval must be positive")
+	check(c.Jobs.FineAccrualInterval > 0, "jobs.fine_accrual_interval must be positive")
+	check(c.Jobs.HoldExpiryInterval > 0, "jobs.hold_expiry_interval must be positive")
+	check(c.Jobs.ThrottlePurgeInterval > 0, "jobs.throttle_purge_interval must be positive")
+
+	switch c.Mail.Driver {
+	case "smtp":
+		check(c.Mail.SMTPHost != "", "mail.smtp_host is required when mail.driver is smtp")
+		check(c.Mail.SMTPPort > 0 && c.Mail.SMTPPort < 65536, "mail.smtp_port must be between 1 and 65535, got %d", c.Mail.SMTPPort)
+	case "file":
+		check(c.Mail.FileDir != "", "mail.file_dir is required when mail.driver is file")
+	case "log":
+	default:
+		check(false, "mail.driver must be one of smtp, file, log, got %q", c.Mail.Driver)
+	}
+	check(c.Mail.From != "", "mail.from is required")
+
+	if c.OIDC.Enabled() {
+		check(c.OIDC.ClientID != "", "oidc.client_id is required when oidc.issuer_url is set")
+		check(c.OIDC.RedirectURL != "", "oidc.redirect_url is required when oidc.issuer_url is set")
+		check(c.OIDC.GroupsClaim != "", "oidc.groups_claim is required when oidc.issuer_url is set")
+		check(c.OIDC.DefaultAccountType != "", "oidc.default_account_type is required when oidc.issuer_url is set")
+		check(c.OIDC.StateTTL > 0, "oidc.state_ttl must be positive")
+		for group, role := range c.OIDC.GroupRoles {
+			check(group != "" && role != "", "oidc.group_roles entries need both a group and a role")
+		}
+	}
+
+	check(c.TwoFactor.Issuer != "", "two_factor.issuer is required")
+	check(c.TwoFactor.ChallengeTTL > 0, "two_factor.challenge_ttl must be positive")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("Default().Validate() = %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	seed := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string
+	}{
+		{"zero port", func(c *Config) { c.Port = 0 }, []string{"port must be between 1 and 65535, got 0"}},
+		{"port too large", func(c *Config) { c.Port = 65536 }, []string{"port must be between"}},
+		{"unknown log level", func(c *Config) { c.LogLevel = "verbose" }, []string{`log_level must be one of debug, info, warn, error, got "verbose"`}},
+		{"negative drain delay", func(c *Config) { c.DrainDelay = -time.Second }, []string{"drain_delay cannot be negative"}},
+		{"missing dsn", func(c *Config) { c.DB.DSN = "" }, []string{"db.dsn is required"}},
+		{"idle above open", func(c *Config) { c.DB.MaxIdleConns = 30 }, []string{"db.max_idle_conns (30) cannot exceed db.max_open_conns (25)"}},
+		{"refresh not longer than auth", func(c *Config) { c.Tokens.RefreshTTL = c.Tokens.AuthTTL }, []string{"tokens.refresh_ttl must be longer than tokens.auth_ttl"}},
+		{"unknown strategy", func(c *Config) { c.Tokens.Strategy = "jwt" }, []string{`tokens.strategy must be one of opaque, signed, got "jwt"`}},
+		{"signed without keys", func(c *Config) { c.Tokens.Strategy = "signed" }, []string{`tokens.signing_key_id "" must name one of tokens.signing_keys`}},
+		{"signed with short key", func(c *Config) {
+			c.Tokens.Strategy = "signed"
+			c.Tokens.SigningKeyID = "k1"
+			c.Tokens.SigningKeys = map[string]string{"k1": "c2hvcnQ="}
+		}, []string{"tokens.signing_keys.k1 must be 32 base64-encoded bytes"}},
+		{"signed with a good key", func(c *Config) {
+			c.Tokens.Strategy = "signed"
+			c.Tokens.SigningKeyID = "k1"
+			c.Tokens.SigningKeys = map[string]string{"k1": seed}
+		}, nil},
+		{"max lockout below user lockout", func(c *Config) { c.Login.MaxLockout = time.Minute }, []string{"login.max_lockout must be at least"}},
+		{"negative renewals", func(c *Config) { c.Loans.MaxRenewals = -1 }, []string{"loans.max_renewals cannot be negative, got -1"}},
+		{"negative rate", func(c *Config) { c.Fines.DailyRatesCents = map[string]int{"general": -5} }, []string{"fines.daily_rates_cents.general cannot be negative, got -5"}},
+		{"zero job interval", func(c *Config) { c.Jobs.HoldExpiryInterval = 0 }, []string{"jobs.hold_expiry_interval must be positive"}},
+		{"smtp without host", func(c *Config) { c.Mail.Driver = "smtp" }, []string{"mail.smtp_host is required when mail.driver is smtp"}},
+		{"unknown mail driver", func(c *Config) { c.Mail.Driver = "sendmail" }, []string{`mail.driver must be one of smtp, file, log, got "sendmail"`}},
+		{"oidc without client", func(c *Config) { c.OIDC.IssuerURL = "https://idp.example.com" }, []string{
+			"oidc.client_id is required when oidc.issuer_url is set",
+		}},
+		{"oidc settings ignored when disabled", func(c *Config) { c.OIDC.ClientID = ""; c.OIDC.StateTTL = 0 }, nil},
+		{"missing two-factor issuer", func(c *Config) { c.TwoFactor.Issuer = "" }, []string{"two_factor.issuer is required"}},
+		{"every error at once", func(c *Config) {
+			c.Port = -1
+			c.DB.DSN = ""
+			c.TwoFactor.ChallengeTTL = 0
+		}, []string{"port must be between", "db.dsn is required", "two_factor.challenge_ttl must be positive"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(cfg)
+
+			err := cfg.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("Validate() = nil, want errors containing %q", tt.want)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "LIBRARY_"
+
+type setting struct {
+	key   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"port", "HTTP listen port", intSetting(func(c *Config) *int { return &c.Port })},
+	{"log_level", "minimum log level: debug, info, warn or error", stringSetting(func(c *Config) *string { return &c.LogLevel })},
+	{"drain_delay", "time to report draining on /api/health before shutting down", durationSetting(func(c *Config) *time.Duration { return &c.DrainDelay })},
+	{"shutdown_timeout", "time allowed for in-flight requests to finish on shutdown", durationSetting(func(c *Config) *time.Duration { return &c.ShutdownTimeout })},
+
+	{"db.dsn", "PostgreSQL connection string", stringSetting(func(c *Config) *string { return &c.DB.DSN })},
+	{"db.max_open_conns", "maximum open database connections", intSetting(func(c *Config) *int { return &c.DB.MaxOpenConns })},
+	{"db.max_idle_conns", "maximum idle database connections", intSetting(func(c *Config) *int { return &c.DB.MaxIdleConns })},
+	{"db.conn_max_lifetime", "maximum lifetime of a database connection", durationSetting(func(c *Config) *time.Duration { return &c.DB.ConnMaxLifetime })},
+
+	{"tokens.auth_ttl", "lifetime of access tokens", durationSetting(func(c *Config) *time.Duration { return &c.Tokens.AuthTTL })},
+	{"tokens.refresh_ttl", "lifetime of refresh tokens, renewed on every refresh", durationSetting(func(c *Config) *time.Duration { return &c.Tokens.RefreshTTL })},
+	{"tokens.password_reset_ttl", "lifetime of password reset tokens", durationSetting(func(c *Config) *time.Duration { return &c.Tokens.PasswordResetTTL })},
+	{"tokens.activation_ttl", "lifetime of email activation tokens", durationSetting(func(c *Config) *time.Duration { return &c.Tokens.ActivationTTL })},
+	{"tokens.strategy", "access tokens: opaque (stored) or signed (Ed25519 JWT)", stringSetting(func(c *Config) *string { return &c.Tokens.Strategy })},
+	{"tokens.signing_key_id", "key ID new signed tokens are signed with", stringSetting(func(c *Config) *string { return &c.Tokens.SigningKeyID })},
+	{"tokens.signing_keys", "signing keys by ID as base64 Ed25519 seeds, e.g. k2=...,k1=...", setSigningKeys},
+	{"tokens.revocation_refresh", "how often the signed token revocation list is reloaded", durationSetting(func(c *Config) *time.Duration { return &c.Tokens.RevocationRefresh })},
+
+	{"login.user_max_failures", "failed logins per username before lockouts start", intSetting(func(c *Config) *int { return &c.Login.UserMaxFailures })},
+	{"login.user_lockout", "first username lockout, doubling on each further failure", durationSetting(func(c *Config) *time.Duration { return &c.Login.UserLockout })},
+	{"login.ip_max_failures", "failed logins per client address before backoff starts", intSetting(func(c *Config) *int { return &c.Login.IPMaxFailures })},
+	{"login.ip_backoff", "first client address backoff, doubling on each further failure", durationSetting(func(c *Config) *time.Duration { return &c.Login.IPBackoff })},
+	{"login.max_lockout", "longest lockout or backoff applied", durationSetting(func(c *Config) *time.Duration { return &c.Login.MaxLockout })},
+	{"login.failure_window", "quiet period after which failure counts restart", durationSetting(func(c *Config) *time.Duration { return &c.Login.FailureWindow })},
+
+	{"loans.period", "loan period for a borrow or renewal", durationSetting(func(c *Config) *time.Duration { return &c.Loans.Period })},
+	{"loans.max_renewals", "renewals allowed per loan", intSetting(func(c *Config) *int { return &c.Loans.MaxRenewals })},
+	{"loans.hold_pickup_window", "time a patron has to collect a ready hold", durationSetting(func(c *Config) *time.Duration { return &c.Loans.HoldPickupWindow })},
+
+	{"fines.max_balance_cents", "outstanding balance above which borrowing is refused", intSetting(func(c *Config) *int { return &c.Fines.MaxBalanceCents })},
+	{"fines.daily_rates_cents", "daily fine per category, e.g. general=25,reference=100", setRates},
+
+	{"jobs.token_purge_interval", "how often expired tokens are purged", durationSetting(func(c *Config) *time.Duration { return &c.Jobs.TokenPurgeInterval })},
+	{"jobs.overdue_scan_interval", "how often loans are checked for being overdue", durationSetting(func(c *Config) *time.Duration { return &c.Jobs.OverdueScanInterval })},
+	{"jobs.fine_accrual_interval", "how often overdue fines are accrued", durationSetting(func(c *Config) *time.Duration { return &c.Jobs.FineAccrualInterval })},
+	{"jobs.hold_expiry_interval", "how often uncollected holds are expired", durationSetting(func(c *Config) *time.Duration { return &c.Jobs.HoldExpiryInterval })},
+	{"jobs.throttle_purge_interval", "how often stale login throttles are deleted", durationSetting(func(c *Config) *time.Duration { return &c.Jobs.ThrottlePurgeInterval })},
+
+	{"metrics.token", "bearer token required to scrape /metrics; empty leaves it open", stringSetting(func(c *Config) *string { return &c.Metrics.Token })},
+
+	{"mail.driver", "outbound mail: smtp, file or log", stringSetting(func(c *Config) *string { return &c.Mail.Driver })},
+	{"mail.from", "sender address for outbound mail", stringSetting(func(c *Config) *string { return &c.Mail.From })},
+	{"mail.smtp_host", "SMTP server host", stringSetting(func(c *Config) *string { return &c.Mail.SMTPHost })},
+	{"mail.smtp_port", "SMTP server port", intSetting(func(c *Config) *int { return &c.Mail.SMTPPort })},
+	{"mail.smtp_username", "SMTP username; empty disables authentication", stringSetting(func(c *Config) *string { return &c.Mail.SMTPUsername })},
+	{"mail.smtp_password", "SMTP password", stringSetting(func(c *Config) *string { return &c.Mail.SMTPPassword })},
+	{"mail.file_dir", "directory the file mailer writes to", stringSetting(func(c *Config) *string { return &c.Mail.FileDir })},
+
+	{"oidc.issuer_url", "OpenID Connect issuer; empty disables single sign-on", stringSetting(func(c *Config) *string { return &c.OIDC.IssuerURL })},
+	{"oidc.client_id", "client ID registered with the OpenID Connect provider", stringSetting(func(c *Config) *string { return &c.OIDC.ClientID })},
+	{"oidc.client_secret", "client secret; may be empty for public clients", stringSetting(func(c *Config) *string { return &c.OIDC.ClientSecret })},
+	{"oidc.redirect_url", "absolute URL of /api/auth/oidc/callback as registered with the provider", stringSetting(func(c *Config) *string { return &c.OIDC.RedirectURL })},
+	{"oidc.scopes", "space-separated scopes requested besides openid", stringSetting(func(c *Config) *string { return &c.OIDC.Scopes })},
+	{"oidc.groups_claim", "ID token claim listing the user's groups", stringSetting(func(c *Config) *string { return &c.OIDC.GroupsClaim })},
+	{"oidc.group_roles", "provider group to account type, e.g. library-staff=librarian,it-admins=admin", setGroupRoles},
+	{"oidc.default_account_type", "account type for provisioned users in no mapped group", stringSetting(func(c *Config) *string { return &c.OIDC.DefaultAccountType })},
+	{"oidc.auto_provision", "create accounts for unknown users signing in through the provider", boolSetting(func(c *Config) *bool { return &c.OIDC.AutoProvision })},
+	{"oidc.sync_roles", "also apply group_roles to existing accounts at every sign-in, not just to new ones", boolSetting(func(c *Config) *bool { return &c.OIDC.SyncRoles })},
+	{"oidc.state_ttl", "time allowed to complete a sign-in at the provider", durationSetting(func(c *Config) *time.Duration { return &c.OIDC.StateTTL })},
+
+	{"two_factor.issuer", "name shown for this service in authenticator apps", stringSetting(func(c *Config) *string { return &c.TwoFactor.Issuer })},
+	{"two_factor.challenge_ttl", "time allowed to enter a two-factor code after the password", durationSetting(func(c *Config) *time.Duration { return &c.TwoFactor.ChallengeTTL })},
+	{"two_factor.require_for_admins", "make two-factor authentication mandatory for admin accounts", boolSetting(func(c *Config) *bool { return &c.TwoFactor.RequireForAdmins })},
+}
+
+// Load registers a flag for every setting on fs, parses args and resolves the
+// final configuration. Callers may register their own flags on fs beforehand.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	var configPath string
+	fs.StringVar(&configPath, "config", os.Getenv(envPrefix+"CONFIG"), "path to a YAML or TOML config file")
+
+	flagValues := map[string]string{}
+	for _, s := range settings {
+		key := s.key
+		fs.Func(flagName(key), s.usage, func(value string) error {
+			flagValues[key] = value
+			return nil
+		})
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+
+	if configPath != "" {
+		values, err := readFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.apply(values, "config file "+configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	envValues := map[string]string{}
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(envName(s.key)); ok {
+			envValues[s.key] = value
+		}
+	}
+	if err := cfg.apply(envValues, "environment"); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.apply(flagValues, "flags"); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) apply(values map[string]string, source string) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		s, ok := lookupSetting(key)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", source, key))
+			continue
+		}
+		if err := s.set(c, values[key]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", source, key, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func lookupSetting(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+func flagName(key string) string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(key)
+}
+
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+
+	raw := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("config: %s: unsupported file extension %q (want .yaml, .yml or .toml)", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: %s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	flatten("", raw, values)
+	return values, nil
+}
+
+// flatten turns nested sections into dotted keys. A map that is itself the
+// value of a known setting, such as fines.daily_rates_cents, is rendered in the
+// same "name=value,..." form accepted from the environment and flags.
+func flatten(prefix string, raw map[string]any, out map[string]string) {
+	for name, value := range raw {
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+
+		nested, isMap := value.(map[string]any)
+		if !isMap {
+			out[key] = fmt.Sprint(value)
+			continue
+		}
+
+		if _, known := lookupSetting(key); known {
+			pairs := make([]string, 0, len(nested))
+			for k, v := range nested {
+				pairs = append(pairs, fmt.Sprintf("%s=%v", k, v))
+			}
+			sort.Strings(pairs)
+			out[key] = strings.Join(pairs, ",")
+			continue
+		}
+
+		flatten(key, nested, out)
+	}
+}
+
+func stringSetting(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func intSetting(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func boolSetting(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func durationSetting(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		d, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a valid duration", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a valid duration", value)
+	}
+	return d, nil
+}
+
+func setRates(c *Config, value string) error {
+	rates := map[string]int{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		category, cents, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("%q is not in category=cents form", pair)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(cents))
+		if err != nil {
+			return fmt.Errorf("rate for %q is not an integer", category)
+		}
+		rates[strings.TrimSpace(category)] = n
+	}
+
+	c.Fines.DailyRatesCents = rates
+	return nil
+}
+
+func setGroupRoles(c *Config, value string) error {
+	roles := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		group, role, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("%q is not in group=role form", pair)
+		}
+		roles[strings.TrimSpace(group)] = strings.TrimSpace(role)
+	}
+
+	c.OIDC.GroupRoles = roles
+	return nil
+}
+
+func setSigningKeys(c *Config, value string) error {
+	keys := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		// Cut at the first "=", since base64 seeds end in padding.
+		id, seed, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("signing key is not in id=seed form")
+		}
+		keys[strings.TrimSpace(id)] = strings.TrimSpace(seed)
+	}
+
+	c.Tokens.SigningKeys = keys
+	return nil
+}
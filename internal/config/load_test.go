@@ -0,0 +1,190 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("write config file: %v", err)
+	}
+	return path
+}
+
+func load(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return Load(fs, args)
+}
+
+const yamlFile = `
+port: 9000
+log_level: warn
+loans:
+  period: 7d
+  max_renewals: 4
+fines:
+  daily_rates_cents:
+    general: 30
+    reference: 90
+`
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "library.yaml", yamlFile)
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(t *testing.T, c *Config)
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, c *Config) {
+				if c.Port != 8080 || c.LogLevel != "info" || c.Loans.Period != 14*24*time.Hour {
+					t.Errorf("got port %d, log_level %q, loans.period %v; want the defaults", c.Port, c.LogLevel, c.Loans.Period)
+				}
+			},
+		},
+		{
+			name: "file beats defaults",
+			args: []string{"-config", path},
+			check: func(t *testing.T, c *Config) {
+				if c.Port != 9000 || c.LogLevel != "warn" || c.Loans.Period != 7*24*time.Hour || c.Loans.MaxRenewals != 4 {
+					t.Errorf("got port %d, log_level %q, loans.period %v, max_renewals %d; want the file's values", c.Port, c.LogLevel, c.Loans.Period, c.Loans.MaxRenewals)
+				}
+				if want := map[string]int{"general": 30, "reference": 90}; !reflect.DeepEqual(c.Fines.DailyRatesCents, want) {
+					t.Errorf("daily rates = %v, want %v", c.Fines.DailyRatesCents, want)
+				}
+				if c.Tokens.AuthTTL != 15*time.Minute {
+					t.Errorf("tokens.auth_ttl = %v, want the default kept", c.Tokens.AuthTTL)
+				}
+			},
+		},
+		{
+			name: "environment beats file",
+			env:  map[string]string{"LIBRARY_PORT": "9100", "LIBRARY_FINES_DAILY_RATES_CENTS": "general=40"},
+			args: []string{"-config", path},
+			check: func(t *testing.T, c *Config) {
+				if c.Port != 9100 || c.LogLevel != "warn" {
+					t.Errorf("got port %d, log_level %q; want 9100 from the environment and warn from the file", c.Port, c.LogLevel)
+				}
+				if want := map[string]int{"general": 40}; !reflect.DeepEqual(c.Fines.DailyRatesCents, want) {
+					t.Errorf("daily rates = %v, want %v", c.Fines.DailyRatesCents, want)
+				}
+			},
+		},
+		{
+			name: "flags beat environment",
+			env:  map[string]string{"LIBRARY_PORT": "9100", "LIBRARY_LOANS_MAX_RENEWALS": "1"},
+			args: []string{"-config", path, "-port", "9200", "-log-level", "debug"},
+			check: func(t *testing.T, c *Config) {
+				if c.Port != 9200 || c.LogLevel != "debug" || c.Loans.MaxRenewals != 1 || c.Loans.Period != 7*24*time.Hour {
+					t.Errorf("got port %d, log_level %q, max_renewals %d, loans.period %v; want flag, flag, environment, file", c.Port, c.LogLevel, c.Loans.MaxRenewals, c.Loans.Period)
+				}
+			},
+		},
+		{
+			name: "config path from the environment",
+			env:  map[string]string{"LIBRARY_CONFIG": path},
+			check: func(t *testing.T, c *Config) {
+				if c.Port != 9000 {
+					t.Errorf("port = %d, want 9000 from the file named by LIBRARY_CONFIG", c.Port)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := load(t, tt.args...)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeConfigFile(t, "library.toml", `
+port = 9300
+
+[oidc]
+issuer_url = "https://idp.example.com"
+client_id = "library"
+redirect_url = "https://library.example.com/api/auth/oidc/callback"
+
+[oidc.group_roles]
+staff = "librarian"
+`)
+
+	cfg, err := load(t, "-config", path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if cfg.Port != 9300 || cfg.OIDC.ClientID != "library" {
+		t.Errorf("got port %d, oidc.client_id %q; want the file's values", cfg.Port, cfg.OIDC.ClientID)
+	}
+	if want := map[string]string{"staff": "librarian"}; !reflect.DeepEqual(cfg.OIDC.GroupRoles, want) {
+		t.Errorf("group roles = %v, want %v", cfg.OIDC.GroupRoles, want)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"unknown file setting", "colour: blue\n", nil, nil, `unknown setting "colour"`},
+		{"bad file value", "loans:\n  period: fortnight\n", nil, nil, `loans.period: "fortnight" is not a valid duration`},
+		{"bad environment value", "", map[string]string{"LIBRARY_PORT": "eighty"}, nil, `environment: port: "eighty" is not an integer`},
+		{"bad flag value", "", nil, []string{"-two-factor-require-for-admins", "maybe"}, `flags: two_factor.require_for_admins: "maybe" is not a boolean`},
+		{"invalid result", "", nil, []string{"-log-level", "loud"}, `log_level must be one of`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, "library.yaml", tt.file)}, args...)
+			}
+
+			_, err := load(t, args...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Load err = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadUnsupportedExtension(t *testing.T) {
+	path := writeConfigFile(t, "library.ini", "port=9000\n")
+
+	_, err := load(t, "-config", path)
+	if err == nil || !strings.Contains(err.Error(), `unsupported file extension ".ini"`) {
+		t.Fatalf("Load err = %v, want an unsupported extension error", err)
+	}
+}
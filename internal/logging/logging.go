@@ -0,0 +1,115 @@
+// Package logging builds the server's structured logger and carries
+// per-request details through the context, so any line logged with a
+// request's context is tagged with its request ID and user.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+type contextKey string
+
+const (
+	requestInfoKey = contextKey("requestInfo")
+	loggerKey      = contextKey("logger")
+)
+
+// RequestInfo is shared by everything handling one request. Authentication
+// runs deeper in the chain than the access log, so the user ID is filled in
+// on this shared value rather than on a derived context.
+type RequestInfo struct {
+	ID string
+
+	mu     sync.Mutex
+	userID int64
+}
+
+func (ri *RequestInfo) SetUserID(id int64) {
+	ri.mu.Lock()
+	ri.userID = id
+	ri.mu.Unlock()
+}
+
+func (ri *RequestInfo) UserID() int64 {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	return ri.userID
+}
+
+func WithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey, info)
+}
+
+// GetRequestInfo returns nil outside of a request.
+func GetRequestInfo(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey).(*RequestInfo)
+	return info
+}
+
+// SetUserID records the authenticated user for the request, if any.
+func SetUserID(ctx context.Context, id int64) {
+	if info := GetRequestInfo(ctx); info != nil {
+		info.SetUserID(id)
+	}
+}
+
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext returns the logger placed in ctx by NewContext, or the default
+// logger. Either way, records logged with ctx carry the request details.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// New returns a JSON logger writing to w at the given level name (debug,
+// info, warn or error; anything else means info).
+func New(w io.Writer, level string) *slog.Logger {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: ParseLevel(level)})
+	return slog.New(contextHandler{handler})
+}
+
+func ParseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// contextHandler adds the request ID and user ID from the context to every
+// record logged with one of the *Context methods.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if info := GetRequestInfo(ctx); info != nil {
+		record.AddAttrs(slog.String("request_id", info.ID))
+		if userID := info.UserID(); userID != 0 {
+			record.AddAttrs(slog.Int64("user_id", userID))
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,111 @@
+// Package metrics defines the Prometheus metrics the server exports on
+// /metrics. Everything is registered on a private registry so tests and
+// multiple Application instances never collide on the global one.
+package metrics
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "library"
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	HTTPRequestDuration *prometheus.HistogramVec
+	BooksBorrowed       prometheus.Counter
+	BooksReturned       prometheus.Counter
+	LoansMarkedOverdue  prometheus.Counter
+	FailedLogins        prometheus.Counter
+}
+
+// New registers the standard process and Go collectors, the connection pool
+// stats of db, and a gauge of live authentication tokens read through
+// activeTokens at scrape time.
+func New(db *sql.DB, activeTokens func() (int64, error), logger *slog.Logger) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		HTTPRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to serve HTTP requests, by route pattern and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+
+		BooksBorrowed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "books_borrowed_total",
+			Help:      "Loans created.",
+		}),
+		BooksReturned: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "books_returned_total",
+			Help:      "Loans returned.",
+		}),
+		LoansMarkedOverdue: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "loans_marked_overdue_total",
+			Help:      "Loans flagged overdue by the background scan.",
+		}),
+		FailedLogins: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "failed_logins_total",
+			Help:      "Login attempts rejected for bad credentials.",
+		}),
+	}
+
+	activeTokensGauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_tokens",
+		Help:      "Unexpired authentication tokens.",
+	}, func() float64 {
+		n, err := activeTokens()
+		if err != nil {
+			logger.Error("metrics: count active tokens", "error", err)
+			return 0
+		}
+		return float64(n)
+	})
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db, "postgres"),
+		m.HTTPRequestDuration,
+		m.BooksBorrowed,
+		m.BooksReturned,
+		m.LoansMarkedOverdue,
+		m.FailedLogins,
+		activeTokensGauge,
+	)
+
+	return m
+}
+
+// Handler serves the registry. When token is not empty, scrapers must send
+// it as "Authorization: Bearer <token>".
+func (m *Metrics) Handler(token string) http.Handler {
+	h := promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	if token == "" {
+		return h
+	}
+
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -2,20 +2,43 @@ package middleware
 
 import (
 	"context"
+	"log/slog"
 	"net/http"
 	"strings"
 
+	"github.com/kevin120202/library-management-system/internal/logging"
 	"github.com/kevin120202/library-management-system/internal/store"
+	"github.com/kevin120202/library-management-system/internal/tokens"
 	"github.com/kevin120202/library-management-system/internal/utils"
 )
 
 type UserMiddleware struct {
-	UserStore store.UserStore
+	UserStore       store.UserStore
+	PermissionStore store.PermissionStore
+	TokenStore      store.TokenStore
+	APIKeyStore     store.APIKeyStore
+	Logger          *slog.Logger
+
+	// RequireAdminTwoFactor confines admins without two-factor
+	// authentication to the routes wrapped in RequireUserForTwoFactorSetup.
+	RequireAdminTwoFactor bool
+
+	// Signer, when set, lets Authenticate accept signed access tokens and
+	// check them against Revocations without touching the database.
+	Signer      *tokens.Signer
+	Revocations *tokens.RevocationList
 }
 
 type contextKey string
 
-const UserContextKey = contextKey("user")
+const (
+	UserContextKey   = contextKey("user")
+	TokenContextKey  = contextKey("token")
+	APIKeyContextKey = contextKey("apiKey")
+	ClaimsContextKey = contextKey("claims")
+
+	scopeGrantedContextKey = contextKey("scopeGranted")
+)
 
 func SetUser(r *http.Request, user *store.User) *http.Request {
 	ctx := context.WithValue(r.Context(), UserContextKey, user)
@@ -30,6 +53,36 @@ func GetUser(r *http.Request) *store.User {
 	return user
 }
 
+// GetToken returns the bearer token the request was authenticated with, or ""
+// for anonymous requests.
+func GetToken(r *http.Request) string {
+	token, _ := r.Context().Value(TokenContextKey).(string)
+	return token
+}
+
+// GetAPIKey returns the API key the request was authenticated with, or nil
+// when it used a session token or no credentials.
+func GetAPIKey(r *http.Request) *store.APIKey {
+	key, _ := r.Context().Value(APIKeyContextKey).(*store.APIKey)
+	return key
+}
+
+// GetAccessClaims returns the claims of the signed access token the request
+// was authenticated with, or nil for any other kind of credential.
+func GetAccessClaims(r *http.Request) *tokens.AccessClaims {
+	claims, _ := r.Context().Value(ClaimsContextKey).(*tokens.AccessClaims)
+	return claims
+}
+
+func grantScope(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), scopeGrantedContextKey, true))
+}
+
+func scopeGranted(r *http.Request) bool {
+	granted, _ := r.Context().Value(scopeGrantedContextKey).(bool)
+	return granted
+}
+
 func (um *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
@@ -47,8 +100,19 @@ func (um *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 		}
 
 		token := headerParts[1]
-		user, err := um.UserStore.GetUserToken(token)
+		if strings.HasPrefix(token, tokens.APIKeyPrefix) {
+			um.authenticateAPIKey(w, r, next, token)
+			return
+		}
+
+		if um.Signer != nil && tokens.IsSigned(token) {
+			um.authenticateSigned(w, r, next, token)
+			return
+		}
+
+		user, err := um.UserStore.GetUserToken(tokens.ScopeAuth, token)
 		if err != nil {
+			um.Logger.ErrorContext(r.Context(), "getUserToken", "error", err)
 			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid token"})
 			return
 		}
@@ -58,18 +122,180 @@ func (um *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		user.Permissions, err = um.PermissionStore.GetPermissionsForRole(user.AccountType)
+		if err != nil {
+			um.Logger.ErrorContext(r.Context(), "getPermissionsForRole", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+
+		err = um.TokenStore.TouchToken(token)
+		if err != nil {
+			um.Logger.ErrorContext(r.Context(), "touchToken", "error", err)
+		}
+
+		logging.SetUserID(r.Context(), int64(user.ID))
+		r = r.WithContext(context.WithValue(r.Context(), TokenContextKey, token))
 		r = SetUser(r, user)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticateSigned trusts what a signed access token says about its user,
+// so it needs no database query. Role changes reach the token on its next
+// refresh; revocations within the revocation list's refresh interval.
+func (um *UserMiddleware) authenticateSigned(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	claims, err := um.Signer.Verify(token)
+	if err != nil || um.Revocations.Revoked(claims) {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "token expired or invalid"})
+		return
+	}
+
+	user := &store.User{
+		ID:               claims.UserID,
+		Username:         claims.Username,
+		AccountType:      claims.Role,
+		Activated:        claims.Activated,
+		TwoFactorEnabled: claims.TwoFactorEnabled,
+		Permissions:      claims.Permissions,
+	}
+
+	logging.SetUserID(r.Context(), int64(user.ID))
+	ctx := context.WithValue(r.Context(), TokenContextKey, token)
+	ctx = context.WithValue(ctx, ClaimsContextKey, claims)
+	r = SetUser(r.WithContext(ctx), user)
+	next.ServeHTTP(w, r)
+}
+
+// authenticateAPIKey signs the request in as the key's owner, but with only
+// the permissions that both the owner's role and the key's scopes grant.
+func (um *UserMiddleware) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	user, key, err := um.APIKeyStore.GetUserForAPIKey(plaintext)
+	if err != nil {
+		um.Logger.ErrorContext(r.Context(), "getUserForAPIKey", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user == nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "API key expired or invalid"})
+		return
+	}
+
+	if !key.AllowsIP(utils.ClientIP(r)) {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "this API key cannot be used from your address"})
+		return
+	}
+
+	rolePermissions, err := um.PermissionStore.GetPermissionsForRole(user.AccountType)
+	if err != nil {
+		um.Logger.ErrorContext(r.Context(), "getPermissionsForRole", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	user.Permissions = []string{}
+	for _, permission := range rolePermissions {
+		if key.HasScope(permission) {
+			user.Permissions = append(user.Permissions, permission)
+		}
+	}
+
+	err = um.APIKeyStore.TouchAPIKey(key.ID)
+	if err != nil {
+		um.Logger.ErrorContext(r.Context(), "touchAPIKey", "error", err)
+	}
+
+	logging.SetUserID(r.Context(), int64(user.ID))
+	r = r.WithContext(context.WithValue(r.Context(), APIKeyContextKey, key))
+	r = SetUser(r, user)
+	next.ServeHTTP(w, r)
+}
+
+// RequireUser also turns away API keys unless an enclosing RequireScope or
+// RequirePermission has cleared the route for them, so new routes are closed
+// to integrations until someone decides otherwise.
 func (um *UserMiddleware) RequireUser(next http.HandlerFunc) http.HandlerFunc {
+	return um.requireUser(next, false)
+}
+
+// RequireUserForTwoFactorSetup is RequireUser for the routes an admin must
+// still reach when policy requires two-factor authentication they have not
+// set up yet.
+func (um *UserMiddleware) RequireUserForTwoFactorSetup(next http.HandlerFunc) http.HandlerFunc {
+	return um.requireUser(next, true)
+}
+
+func (um *UserMiddleware) requireUser(next http.HandlerFunc, twoFactorSetup bool) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := GetUser(r)
 		if user.IsAnonymous() {
 			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "you must be logged in to access this route"})
 			return
 		}
+		if GetAPIKey(r) != nil && !scopeGranted(r) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "this route cannot be used with an API key"})
+			return
+		}
+		if !twoFactorSetup && um.TwoFactorRequired(user) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "two-factor authentication is required for your account; set it up at /api/users/me/2fa"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TwoFactorRequired reports whether policy requires user to set up
+// two-factor authentication before doing anything else.
+func (um *UserMiddleware) TwoFactorRequired(user *store.User) bool {
+	return um.RequireAdminTwoFactor && user.IsAdmin() && !user.TwoFactorEnabled
+}
+
+// RequireScope lets API keys carrying scope through to next, which is
+// normally wrapped in RequireUser or a stricter check. Session tokens pass
+// straight through.
+func (um *UserMiddleware) RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := GetAPIKey(r); key != nil {
+			if !key.HasScope(scope) {
+				utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "this API key lacks the " + scope + " scope"})
+				return
+			}
+			r = grantScope(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireActivatedUser keeps accounts whose email has not been verified away
+// from routes that commit library stock, such as borrowing and holds.
+func (um *UserMiddleware) RequireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return um.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		user := GetUser(r)
+		if !user.Activated {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "your account must be activated to access this route"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequirePermission only lets the request through when the user's role
+// grants the permission, e.g. RequirePermission("books:write", handler).
+//
+// API keys may use these routes too: Authenticate has already cut their
+// permissions down to the key's scopes.
+func (um *UserMiddleware) RequirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	check := um.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		user := GetUser(r)
+		if !user.HasPermission(permission) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you do not have permission to access this route"})
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		check(w, grantScope(r))
+	}
 }
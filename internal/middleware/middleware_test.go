@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kevin120202/library-management-system/internal/store"
+)
+
+func TestRequireUser(t *testing.T) {
+	patron := &store.User{ID: 1, AccountType: "patron"}
+	admin := &store.User{ID: 2, AccountType: "admin"}
+	kioskKey := &store.APIKey{ID: 9, UserID: 1, Scopes: []string{"catalog:read"}}
+
+	um := &UserMiddleware{RequireAdminTwoFactor: true}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		user    *store.User
+		key     *store.APIKey
+		want    int
+	}{
+		{"anonymous", um.RequireUser(ok), store.AnonymousUser, nil, http.StatusUnauthorized},
+		{"session", um.RequireUser(ok), patron, nil, http.StatusNoContent},
+		{"API key", um.RequireUser(ok), patron, kioskKey, http.StatusForbidden},
+		{"API key with scope", um.RequireScope("catalog:read", um.RequireUser(ok)), patron, kioskKey, http.StatusNoContent},
+		{"API key lacking scope", um.RequireScope("loans:write", um.RequireUser(ok)), patron, kioskKey, http.StatusForbidden},
+		{"admin owing two-factor", um.RequireUser(ok), admin, nil, http.StatusForbidden},
+		{"admin owing two-factor, setup route", um.RequireUserForTwoFactorSetup(ok), admin, nil, http.StatusNoContent},
+		{"API key, setup route", um.RequireUserForTwoFactorSetup(ok), patron, kioskKey, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := SetUser(httptest.NewRequest(http.MethodPost, "/api/logout", nil), tt.user)
+			if tt.key != nil {
+				r = r.WithContext(context.WithValue(r.Context(), APIKeyContextKey, tt.key))
+			}
+			w := httptest.NewRecorder()
+
+			tt.handler(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
@@ -3,27 +3,93 @@ package routes
 import (
 	"github.com/go-chi/chi/v5"
 	"github.com/kevin120202/library-management-system/internal/app"
+	"github.com/kevin120202/library-management-system/internal/middleware"
 )
 
 func SetupRoutes(app *app.Application) *chi.Mux {
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID(app.Logger))
+	r.Use(middleware.AccessLog(app.Logger))
+	r.Use(middleware.Instrument(app.Metrics))
 
 	r.Group(func(r chi.Router) {
 		r.Use(app.Middleware.Authenticate)
 
-		r.Get("/api/books/{id}", app.Middleware.RequireUser(app.BookHandler.HandleGetBookByID))
-		r.Get("/api/books", app.Middleware.RequireUser(app.BookHandler.HandleGetBooks))
-		r.Post("/api/books", app.Middleware.RequireUser(app.BookHandler.HandleCreateBook))
-		r.Put("/api/books/{id}", app.Middleware.RequireUser(app.BookHandler.HandleUpdateBookByID))
-		r.Delete("/api/books/{id}", app.Middleware.RequireUser(app.BookHandler.HandleDeleteBookByID))
+		r.Get("/api/books/search", app.Middleware.RequireScope("catalog:read", app.Middleware.RequireUser(app.BookHandler.HandleSearchBooks)))
+		r.Get("/api/books/{id}", app.Middleware.RequireScope("catalog:read", app.Middleware.RequireUser(app.BookHandler.HandleGetBookByID)))
+		r.Get("/api/books", app.Middleware.RequireScope("catalog:read", app.Middleware.RequireUser(app.BookHandler.HandleGetBooks)))
+		r.Post("/api/books", app.Middleware.RequirePermission("books:write", app.BookHandler.HandleCreateBook))
+		r.Put("/api/books/{id}", app.Middleware.RequirePermission("books:write", app.BookHandler.HandleUpdateBookByID))
+		r.Delete("/api/books/{id}", app.Middleware.RequirePermission("books:write", app.BookHandler.HandleDeleteBookByID))
+		r.Post("/api/books/{id}/borrow", app.Middleware.RequireScope("loans:write", app.Middleware.RequireActivatedUser(app.BookHandler.HandleBorrowBook)))
+		r.Post("/api/books/{id}/holds", app.Middleware.RequireScope("loans:write", app.Middleware.RequireActivatedUser(app.HoldHandler.HandleCreateHold)))
 
-		r.Post("/api/logout", app.UserHandler.HandleLogoutUser)
+		r.Get("/api/books/{id}/items", app.Middleware.RequireScope("catalog:read", app.Middleware.RequireUser(app.ItemHandler.HandleGetItems)))
+		r.Post("/api/books/{id}/items", app.Middleware.RequirePermission("books:write", app.ItemHandler.HandleCreateItem))
+		r.Get("/api/books/{id}/items/{itemID}", app.Middleware.RequireScope("catalog:read", app.Middleware.RequireUser(app.ItemHandler.HandleGetItemByID)))
+		r.Put("/api/books/{id}/items/{itemID}", app.Middleware.RequirePermission("books:write", app.ItemHandler.HandleUpdateItem))
+		r.Delete("/api/books/{id}/items/{itemID}", app.Middleware.RequirePermission("books:write", app.ItemHandler.HandleDeleteItem))
+
+		r.Get("/api/loans", app.Middleware.RequirePermission("loans:override", app.BorrowReturnHandler.HandleListLoans))
+		r.Post("/api/loans/{id}/return", app.Middleware.RequireScope("loans:write", app.Middleware.RequireUser(app.BorrowReturnHandler.HandleReturnBook)))
+		r.Post("/api/loans/{id}/renew", app.Middleware.RequireScope("loans:write", app.Middleware.RequireActivatedUser(app.BorrowReturnHandler.HandleRenewBook)))
+
+		r.Get("/api/users/me/loans", app.Middleware.RequireScope("loans:read", app.Middleware.RequireUser(app.BorrowReturnHandler.HandleGetMyLoans)))
+		r.Get("/api/users/me/holds", app.Middleware.RequireScope("loans:read", app.Middleware.RequireUser(app.HoldHandler.HandleGetMyHolds)))
+		r.Get("/api/users/me/fines", app.Middleware.RequireScope("fines:read", app.Middleware.RequireUser(app.FineHandler.HandleGetMyFines)))
+		r.Get("/api/users/me/sessions", app.Middleware.RequireUser(app.SessionHandler.HandleGetMySessions))
+		r.Delete("/api/users/me/sessions/{id}", app.Middleware.RequireUser(app.SessionHandler.HandleDeleteMySession))
+		r.Get("/api/users/me/api-keys", app.Middleware.RequireUser(app.APIKeyHandler.HandleGetMyAPIKeys))
+		r.Post("/api/users/me/api-keys", app.Middleware.RequireUser(app.APIKeyHandler.HandleCreateAPIKey))
+		r.Get("/api/users/me/api-keys/{id}", app.Middleware.RequireUser(app.APIKeyHandler.HandleGetAPIKey))
+		r.Patch("/api/users/me/api-keys/{id}", app.Middleware.RequireUser(app.APIKeyHandler.HandleUpdateAPIKey))
+		r.Delete("/api/users/me/api-keys/{id}", app.Middleware.RequireUser(app.APIKeyHandler.HandleDeleteAPIKey))
+		r.Post("/api/users/me/2fa", app.Middleware.RequireUserForTwoFactorSetup(app.TwoFactorHandler.HandleEnroll))
+		r.Post("/api/users/me/2fa/verify", app.Middleware.RequireUserForTwoFactorSetup(app.TwoFactorHandler.HandleVerify))
+		r.Delete("/api/users/me/2fa", app.Middleware.RequireUser(app.TwoFactorHandler.HandleDisable))
+		r.Get("/api/users/me", app.Middleware.RequireUser(app.UserHandler.HandleGetMe))
+		r.Patch("/api/users/me", app.Middleware.RequireUser(app.UserHandler.HandleUpdateMe))
+		r.Delete("/api/users/me", app.Middleware.RequireUser(app.UserHandler.HandleDeleteMe))
+		r.Put("/api/users/me/password", app.Middleware.RequireUser(app.UserHandler.HandleChangePassword))
+		r.Post("/api/users/me/activation", app.Middleware.RequireUser(app.UserHandler.HandleResendActivation))
+		r.Post("/api/users/{id}/payments", app.Middleware.RequirePermission("fines:manage", app.FineHandler.HandleCreatePayment))
+
+		r.Get("/api/admin/jobs", app.Middleware.RequirePermission("jobs:read", app.JobHandler.HandleGetJobs))
+
+		r.Get("/api/admin/users", app.Middleware.RequirePermission("users:manage", app.UserHandler.HandleListUsers))
+		r.Post("/api/admin/users", app.Middleware.RequirePermission("users:manage", app.UserHandler.HandleAdminCreateUser))
+		r.Patch("/api/admin/users/{id}/role", app.Middleware.RequirePermission("users:manage", app.UserHandler.HandleUpdateUserRole))
+		r.Delete("/api/admin/users/{id}/lockout", app.Middleware.RequirePermission("users:manage", app.UserHandler.HandleUnlockUser))
+		r.Delete("/api/admin/users/{id}/sessions", app.Middleware.RequirePermission("users:manage", app.UserHandler.HandleRevokeUserSessions))
+		r.Delete("/api/admin/users/{id}/2fa", app.Middleware.RequirePermission("users:manage", app.TwoFactorHandler.HandleAdminResetTwoFactor))
+
+		r.Get("/api/admin/permissions", app.Middleware.RequirePermission("users:manage", app.RoleHandler.HandleGetPermissions))
+		r.Get("/api/admin/roles", app.Middleware.RequirePermission("users:manage", app.RoleHandler.HandleGetRoles))
+		r.Post("/api/admin/roles", app.Middleware.RequirePermission("users:manage", app.RoleHandler.HandleCreateRole))
+		r.Put("/api/admin/roles/{name}/permissions", app.Middleware.RequirePermission("users:manage", app.RoleHandler.HandleSetRolePermissions))
+		r.Delete("/api/admin/roles/{name}", app.Middleware.RequirePermission("users:manage", app.RoleHandler.HandleDeleteRole))
+
+		// Admins who still owe two-factor setup may at least sign out.
+		r.Post("/api/logout", app.Middleware.RequireUserForTwoFactorSetup(app.UserHandler.HandleLogoutUser))
 	})
 
-	r.Get("/api/health", app.HealthCheck)
+	r.Get("/metrics", app.Metrics.Handler(app.Config.Metrics.Token).ServeHTTP)
+
+	r.Get("/api/health", app.HealthHandler.HandleReady)
+	r.Get("/api/health/live", app.HealthHandler.HandleLive)
+	r.Get("/api/health/ready", app.HealthHandler.HandleReady)
 
 	r.Post("/api/users", app.UserHandler.HandleRegisterUser)
+	r.Put("/api/users/activated", app.UserHandler.HandleActivateUser)
 	r.Post("/api/authentication", app.TokenHandler.HandleCreateToken)
+	r.Post("/api/authentication/2fa", app.TokenHandler.HandleTwoFactorLogin)
+	r.Post("/api/authentication/refresh", app.TokenHandler.HandleRefreshToken)
+	if app.OIDCHandler != nil {
+		r.Get("/api/auth/oidc/login", app.OIDCHandler.HandleLogin)
+		r.Get("/api/auth/oidc/callback", app.OIDCHandler.HandleCallback)
+	}
+	r.Post("/api/password-reset", app.PasswordResetHandler.HandleRequestPasswordReset)
+	r.Put("/api/password-reset", app.PasswordResetHandler.HandleCompletePasswordReset)
 
 	return r
 }
@@ -0,0 +1,199 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RunFunc does one pass of a job and reports how many rows it touched.
+type RunFunc func() (int64, error)
+
+type JobStatus struct {
+	Name          string     `json:"name"`
+	Interval      string     `json:"interval"`
+	Running       bool       `json:"running"`
+	Runs          int        `json:"runs"`
+	LastRunAt     *time.Time `json:"last_run_at"`
+	LastDuration  string     `json:"last_duration"`
+	LastError     string     `json:"last_error"`
+	LastAffected  int64      `json:"last_affected"`
+	LastSkippedAt *time.Time `json:"last_skipped_at"`
+}
+
+type job struct {
+	name     string
+	interval time.Duration
+	run      RunFunc
+	lockKey  int64
+
+	mu       sync.Mutex
+	status   JobStatus
+	lastTick time.Time
+}
+
+// Scheduler runs registered jobs on their own intervals. Each pass takes a
+// Postgres advisory lock named after the job, so when several replicas share
+// a database only one of them does the work.
+type Scheduler struct {
+	db     *sql.DB
+	logger *slog.Logger
+	jobs   []*job
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func New(db *sql.DB, logger *slog.Logger) *Scheduler {
+	return &Scheduler{
+		db:     db,
+		logger: logger,
+		stop:   make(chan struct{}),
+	}
+}
+
+// Register adds a job. It must be called before Start.
+func (s *Scheduler) Register(name string, interval time.Duration, run RunFunc) {
+	h := fnv.New64a()
+	h.Write([]byte("scheduler:" + name))
+
+	s.jobs = append(s.jobs, &job{
+		name:     name,
+		interval: interval,
+		run:      run,
+		lockKey:  int64(h.Sum64()),
+		status: JobStatus{
+			Name:     name,
+			Interval: interval.String(),
+		},
+	})
+}
+
+func (s *Scheduler) Start() {
+	now := time.Now()
+	for _, j := range s.jobs {
+		j.lastTick = now
+		s.wg.Add(1)
+		go s.loop(j)
+	}
+}
+
+// Stop signals every job loop to exit and waits for in-flight passes to finish.
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+func (s *Scheduler) Statuses() []JobStatus {
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		j.mu.Lock()
+		statuses = append(statuses, j.status)
+		j.mu.Unlock()
+	}
+
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Name < statuses[k].Name })
+	return statuses
+}
+
+// Stale returns the jobs whose loop has not woken up within twice its
+// interval, which means the loop is stuck in a pass or has exited.
+func (s *Scheduler) Stale() []string {
+	stale := []string{}
+	for _, j := range s.jobs {
+		j.mu.Lock()
+		last := j.lastTick
+		j.mu.Unlock()
+
+		if last.IsZero() || time.Since(last) > 2*j.interval {
+			stale = append(stale, j.name)
+		}
+	}
+
+	sort.Strings(stale)
+	return stale
+}
+
+func (s *Scheduler) loop(j *job) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		j.mu.Lock()
+		j.lastTick = time.Now()
+		j.mu.Unlock()
+
+		s.runOnce(j)
+
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) runOnce(j *job) {
+	ctx := context.Background()
+
+	// Advisory locks belong to a session, so lock and unlock have to happen
+	// on the same pooled connection.
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		s.finish(j, time.Now(), 0, 0, err)
+		return
+	}
+	defer conn.Close()
+
+	var locked bool
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, j.lockKey).Scan(&locked)
+	if err != nil {
+		s.finish(j, time.Now(), 0, 0, err)
+		return
+	}
+
+	if !locked {
+		now := time.Now()
+		j.mu.Lock()
+		j.status.LastSkippedAt = &now
+		j.mu.Unlock()
+		return
+	}
+
+	defer func() {
+		_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, j.lockKey)
+		if err != nil {
+			s.logger.Error("scheduler: unlock", "job", j.name, "error", err)
+		}
+	}()
+
+	j.mu.Lock()
+	j.status.Running = true
+	j.mu.Unlock()
+
+	startedAt := time.Now()
+	affected, err := j.run()
+	s.finish(j, startedAt, time.Since(startedAt), affected, err)
+}
+
+func (s *Scheduler) finish(j *job, startedAt time.Time, duration time.Duration, affected int64, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastRunAt = &startedAt
+	j.status.LastDuration = duration.String()
+	j.status.LastAffected = affected
+	j.status.LastError = ""
+
+	if err != nil {
+		j.status.LastError = err.Error()
+		s.logger.Error("scheduler: job failed", "job", j.name, "error", err)
+	}
+}
@@ -0,0 +1,336 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockProvider is a minimal OpenID Connect provider: discovery, a JWKS and a
+// token endpoint that enforces PKCE. Tests skip the browser and call
+// authorize to get a code for a login.
+type mockProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// signingKey signs ID tokens; it differs from key only when a test
+	// wants a signature the published JWKS cannot verify.
+	signingKey *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]issuedCode
+}
+
+type issuedCode struct {
+	challenge string
+	claims    map[string]any
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	p := &mockProvider{t: t, key: key, signingKey: key, codes: map[string]issuedCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]any{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", p.handleToken)
+
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func (p *mockProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	p.mu.Lock()
+	issued, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	signingKey := p.signingKey
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != issued.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": "provider-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     p.sign(signingKey, issued.claims),
+	})
+}
+
+// authorize plays the user approving login at the provider. Claims default
+// to a valid ID token for the login's nonce; overrides replace or, when nil,
+// remove individual claims.
+func (p *mockProvider) authorize(login *Login, overrides map[string]any) string {
+	p.t.Helper()
+
+	authURL, err := url.Parse(login.URL)
+	if err != nil {
+		p.t.Fatalf("parse auth URL: %v", err)
+	}
+
+	query := authURL.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("state") != login.State {
+		p.t.Fatalf("auth URL lacks PKCE or state: %s", login.URL)
+	}
+
+	claims := map[string]any{
+		"iss":            p.server.URL,
+		"sub":            "user-1",
+		"aud":            "library",
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(5 * time.Minute).Unix(),
+		"nonce":          query.Get("nonce"),
+		"email":          "reader@example.com",
+		"email_verified": true,
+		"groups":         []string{"library-staff"},
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+
+	code := rand.Text()
+	p.mu.Lock()
+	p.codes[code] = issuedCode{challenge: query.Get("code_challenge"), claims: claims}
+	p.mu.Unlock()
+
+	return code
+}
+
+func (p *mockProvider) sign(key *rsa.PrivateKey, claims map[string]any) string {
+	p.t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		p.t.Fatalf("marshal claims: %v", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		p.t.Fatalf("sign: %v", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (p *mockProvider) client() *Client {
+	return New(Config{
+		IssuerURL:   p.server.URL,
+		ClientID:    "library",
+		RedirectURL: "http://library.test/api/auth/oidc/callback",
+		Scopes:      []string{"email"},
+		GroupsClaim: "groups",
+	})
+}
+
+func TestFinishReturnsVerifiedIdentity(t *testing.T) {
+	provider := newMockProvider(t)
+	client := provider.client()
+	ctx := context.Background()
+
+	login, err := client.Begin(ctx)
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+
+	code := provider.authorize(login, nil)
+
+	identity, err := client.Finish(ctx, code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+
+	if identity.Issuer != provider.server.URL || identity.Subject != "user-1" {
+		t.Errorf("identity = %s/%s, want %s/user-1", identity.Issuer, identity.Subject, provider.server.URL)
+	}
+	if identity.Email != "reader@example.com" || !identity.EmailVerified {
+		t.Errorf("email = %q verified=%v", identity.Email, identity.EmailVerified)
+	}
+	if len(identity.Groups) != 1 || identity.Groups[0] != "library-staff" {
+		t.Errorf("groups = %v, want [library-staff]", identity.Groups)
+	}
+}
+
+func TestFinishRejectsBadSignIns(t *testing.T) {
+	provider := newMockProvider(t)
+	client := provider.client()
+	ctx := context.Background()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		overrides map[string]any
+		// finish redeems the code, possibly tampering with what the
+		// callback would pass.
+		finish  func(login *Login, code string) (*Identity, error)
+		wantErr error
+	}{
+		{
+			name:      "nonce mismatch",
+			overrides: map[string]any{"nonce": "someone-elses-nonce"},
+			wantErr:   ErrInvalidIDToken,
+		},
+		{
+			name:      "missing nonce",
+			overrides: map[string]any{"nonce": nil},
+			wantErr:   ErrInvalidIDToken,
+		},
+		{
+			name:      "wrong audience",
+			overrides: map[string]any{"aud": "another-client"},
+			wantErr:   ErrInvalidIDToken,
+		},
+		{
+			name:      "expired",
+			overrides: map[string]any{"exp": time.Now().Add(-time.Minute).Unix()},
+			wantErr:   ErrInvalidIDToken,
+		},
+		{
+			name:      "wrong issuer",
+			overrides: map[string]any{"iss": "https://evil.example"},
+			wantErr:   ErrInvalidIDToken,
+		},
+		{
+			name: "wrong PKCE verifier",
+			finish: func(login *Login, code string) (*Identity, error) {
+				other, err := client.Begin(ctx)
+				if err != nil {
+					t.Fatalf("begin: %v", err)
+				}
+				return client.Finish(ctx, code, other.CodeVerifier, login.Nonce)
+			},
+		},
+		{
+			name: "code replayed",
+			finish: func(login *Login, code string) (*Identity, error) {
+				_, err := client.Finish(ctx, code, login.CodeVerifier, login.Nonce)
+				if err != nil {
+					t.Fatalf("first finish: %v", err)
+				}
+				return client.Finish(ctx, code, login.CodeVerifier, login.Nonce)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login, err := client.Begin(ctx)
+			if err != nil {
+				t.Fatalf("begin: %v", err)
+			}
+
+			code := provider.authorize(login, tt.overrides)
+
+			finish := tt.finish
+			if finish == nil {
+				finish = func(login *Login, code string) (*Identity, error) {
+					return client.Finish(ctx, code, login.CodeVerifier, login.Nonce)
+				}
+			}
+
+			identity, err := finish(login, code)
+			if err == nil {
+				t.Fatalf("finish succeeded with identity %+v", identity)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("signed by unknown key", func(t *testing.T) {
+		provider.mu.Lock()
+		provider.signingKey = otherKey
+		provider.mu.Unlock()
+		defer func() {
+			provider.mu.Lock()
+			provider.signingKey = provider.key
+			provider.mu.Unlock()
+		}()
+
+		login, err := client.Begin(ctx)
+		if err != nil {
+			t.Fatalf("begin: %v", err)
+		}
+
+		code := provider.authorize(login, nil)
+
+		_, err = client.Finish(ctx, code, login.CodeVerifier, login.Nonce)
+		if !errors.Is(err, ErrInvalidIDToken) {
+			t.Fatalf("err = %v, want ErrInvalidIDToken", err)
+		}
+	})
+}
+
+func TestUnreachableProvider(t *testing.T) {
+	provider := newMockProvider(t)
+	client := provider.client()
+	provider.server.Close()
+
+	_, err := client.Begin(context.Background())
+	if !errors.Is(err, ErrProviderUnavailable) {
+		t.Fatalf("err = %v, want ErrProviderUnavailable", err)
+	}
+}
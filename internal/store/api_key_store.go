@@ -0,0 +1,246 @@
+package store
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/kevin120202/library-management-system/internal/tokens"
+)
+
+// APIKeyScopes are the scopes an API key may carry beyond the permission
+// codes its owner's role grants. Routes opt in to API key access by naming
+// the scope they need.
+var APIKeyScopes = map[string]string{
+	"catalog:read": "Search and read the catalogue and its copies",
+	"loans:read":   "Read the owner's loans and holds",
+	"loans:write":  "Borrow, return and renew books and place holds",
+	"fines:read":   "Read the owner's fines and payments",
+}
+
+type APIKey struct {
+	ID         int64      `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	AllowedIPs []string   `json:"allowed_ips"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP reports whether ip may use the key. Entries are single addresses
+// or CIDR ranges; an empty list allows any address.
+func (k *APIKey) AllowsIP(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, entry := range k.AllowedIPs {
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err == nil && prefix.Contains(addr) {
+				return true
+			}
+			continue
+		}
+
+		allowed, err := netip.ParseAddr(entry)
+		if err == nil && allowed.Unmap() == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+type PostgresAPIKeyStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAPIKeyStore(db *sql.DB) *PostgresAPIKeyStore {
+	return &PostgresAPIKeyStore{
+		db: db,
+	}
+}
+
+type APIKeyStore interface {
+	CreateAPIKey(key *APIKey, token *tokens.Token) error
+	GetAPIKeysForUser(userID int) ([]APIKey, error)
+	GetAPIKey(userID int, id int64) (*APIKey, error)
+	UpdateAPIKey(key *APIKey) error
+	DeleteAPIKey(userID int, id int64) (bool, error)
+	GetUserForAPIKey(plaintext string) (*User, *APIKey, error)
+	TouchAPIKey(id int64) error
+}
+
+const apiKeyColumns = `api_keys.id, api_keys.user_id, api_keys.name, api_keys.prefix, api_keys.scopes, api_keys.allowed_ips,
+	api_keys.expires_at, api_keys.last_used_at, api_keys.created_at, api_keys.updated_at`
+
+func scanAPIKey(row interface{ Scan(...any) error }, key *APIKey, extra ...any) error {
+	var scopes, allowedIPs pgtype.TextArray
+
+	dest := append([]any{&key.ID, &key.UserID, &key.Name, &key.Prefix, &scopes, &allowedIPs,
+		&key.ExpiresAt, &key.LastUsedAt, &key.CreatedAt, &key.UpdatedAt}, extra...)
+
+	err := row.Scan(dest...)
+	if err != nil {
+		return err
+	}
+
+	key.Scopes = []string{}
+	key.AllowedIPs = []string{}
+
+	err = scopes.AssignTo(&key.Scopes)
+	if err != nil {
+		return err
+	}
+
+	return allowedIPs.AssignTo(&key.AllowedIPs)
+}
+
+// CreateAPIKey stores the hash of token under key. The plaintext is never
+// stored; the caller shows it to the user once.
+func (pg *PostgresAPIKeyStore) CreateAPIKey(key *APIKey, token *tokens.Token) error {
+	key.Prefix = token.Plaintext[:len(tokens.APIKeyPrefix)+6]
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, scopes, allowed_ips, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at, updated_at
+	`
+
+	return pg.db.QueryRow(query, key.UserID, key.Name, key.Prefix, token.Hash, key.Scopes, key.AllowedIPs, key.ExpiresAt).
+		Scan(&key.ID, &key.CreatedAt, &key.UpdatedAt)
+}
+
+func (pg *PostgresAPIKeyStore) GetAPIKeysForUser(userID int) ([]APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = $1 ORDER BY created_at DESC, id DESC`
+
+	rows, err := pg.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err = scanAPIKey(rows, &key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (pg *PostgresAPIKeyStore) GetAPIKey(userID int, id int64) (*APIKey, error) {
+	key := &APIKey{}
+
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = $1 AND id = $2`
+
+	err := scanAPIKey(pg.db.QueryRow(query, userID, id), key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (pg *PostgresAPIKeyStore) UpdateAPIKey(key *APIKey) error {
+	query := `
+		UPDATE api_keys
+		SET name = $1, scopes = $2, allowed_ips = $3, expires_at = $4, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = $5 AND id = $6
+		RETURNING updated_at
+	`
+
+	return pg.db.QueryRow(query, key.Name, key.Scopes, key.AllowedIPs, key.ExpiresAt, key.UserID, key.ID).Scan(&key.UpdatedAt)
+}
+
+func (pg *PostgresAPIKeyStore) DeleteAPIKey(userID int, id int64) (bool, error) {
+	result, err := pg.db.Exec(`DELETE FROM api_keys WHERE user_id = $1 AND id = $2`, userID, id)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return deleted > 0, nil
+}
+
+// GetUserForAPIKey returns the key and its owner, or nils when the key is
+// unknown or expired.
+func (pg *PostgresAPIKeyStore) GetUserForAPIKey(plaintext string) (*User, *APIKey, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT ` + apiKeyColumns + `,
+			users.username, users.email, users.password_hash, users.account_type, users.address, users.activated, users.two_factor_enabled, users.created_at, users.updated_at
+		FROM api_keys
+		INNER JOIN users ON users.id = api_keys.user_id
+		WHERE api_keys.hash = $1
+		AND (api_keys.expires_at IS NULL OR api_keys.expires_at > CURRENT_TIMESTAMP)
+	`
+
+	key := &APIKey{}
+	user := &User{PasswordHash: password{}}
+
+	err := scanAPIKey(pg.db.QueryRow(query, hash[:]), key,
+		&user.Username, &user.Email, &user.PasswordHash.hash, &user.AccountType, &user.Address, &user.Activated, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user.ID = key.UserID
+	return user, key, nil
+}
+
+// TouchAPIKey records use of the key, at most once a minute.
+func (pg *PostgresAPIKeyStore) TouchAPIKey(id int64) error {
+	query := `
+		UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute')
+	`
+
+	_, err := pg.db.Exec(query, id)
+	return err
+}
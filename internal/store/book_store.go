@@ -2,16 +2,80 @@ package store
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
 	"time"
+	"unicode"
+)
+
+var (
+	ErrBookUnavailable = errors.New("book is not available")
+	ErrBookHasLoans    = errors.New("book has loan history")
 )
 
 type Book struct {
-	ID        int       `json:"id"`
-	Title     string    `json:"title"`
-	Author    string    `json:"author"`
-	Summary   string    `json:"summary"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID              int       `json:"id"`
+	Title           string    `json:"title"`
+	Author          string    `json:"author"`
+	Summary         string    `json:"summary"`
+	Category        string    `json:"category"`
+	Available       bool      `json:"available"`
+	CopiesAvailable int       `json:"copies_available"`
+	CopiesTotal     int       `json:"copies_total"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// bookColumns counts copies on the shelf against copies still in
+// circulation; lost and withdrawn items no longer count towards the total.
+// Queries using it must join items and group by books.id.
+const bookColumns = `
+	books.id, books.title, books.author, COALESCE(books.summary, ''), books.category,
+	COUNT(items.id) FILTER (WHERE items.status = 'available'),
+	COUNT(items.id) FILTER (WHERE items.status NOT IN ('lost', 'withdrawn')),
+	books.created_at, books.updated_at
+`
+
+const bookSelect = `
+	SELECT ` + bookColumns + `
+	FROM books
+	LEFT JOIN items ON items.book_id = books.id
+`
+
+func scanBook(row interface{ Scan(...any) error }, book *Book) error {
+	err := row.Scan(&book.ID, &book.Title, &book.Author, &book.Summary, &book.Category, &book.CopiesAvailable, &book.CopiesTotal, &book.CreatedAt, &book.UpdatedAt)
+	book.Available = book.CopiesAvailable > 0
+	return err
+}
+
+type BookListParams struct {
+	ListParams
+	Author    string
+	Available *bool
+}
+
+var bookSortKeys = map[string]sortKey{
+	"title":      {column: "books.title", cast: "TEXT"},
+	"author":     {column: "books.author", cast: "TEXT"},
+	"created_at": {column: "books.created_at", cast: "TIMESTAMPTZ"},
+}
+
+type BookSearchParams struct {
+	Query     string
+	Author    string
+	Available *bool
+	Limit     int
+}
+
+// BookSearchResult's TitleHighlight and SummarySnippet are HTML: the book's
+// text escaped, with matches wrapped in <mark> tags.
+type BookSearchResult struct {
+	Book
+	Rank           float64 `json:"rank"`
+	TitleHighlight string  `json:"title_highlight"`
+	SummarySnippet string  `json:"summary_snippet"`
 }
 
 type PostgresBookStore struct {
@@ -24,11 +88,12 @@ func NewPostgresBookStore(db *sql.DB) *PostgresBookStore {
 
 type BookStore interface {
 	CreateBook(*Book) (*Book, error)
-	GetBooks() ([]Book, error)
+	GetBooks(params BookListParams) (*Page[Book], error)
 	GetBookByID(id int64) (*Book, error)
+	SearchBooks(params BookSearchParams) ([]BookSearchResult, error)
 	UpdateBook(*Book) error
 	DeleteBook(id int64) error
-	BorrowBook(bookID int64, userID int64) (error)
+	BorrowBook(bookID int64, userID int64, loanPeriod time.Duration) (*Loan, error)
 }
 
 func (pg *PostgresBookStore) CreateBook(book *Book) (*Book, error) {
@@ -39,12 +104,12 @@ func (pg *PostgresBookStore) CreateBook(book *Book) (*Book, error) {
 	defer tx.Rollback()
 
 	query := `
-		INSERT INTO books (title, author, summary)
-		VALUES ($1, $2, $3)
-		RETURNING id
+		INSERT INTO books (title, author, summary, category)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, updated_at
 	`
 
-	err = tx.QueryRow(query, book.Title, book.Author, book.Summary).Scan(&book.ID)
+	err = tx.QueryRow(query, book.Title, book.Author, book.Summary, book.Category).Scan(&book.ID, &book.CreatedAt, &book.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -57,45 +122,104 @@ func (pg *PostgresBookStore) CreateBook(book *Book) (*Book, error) {
 	return book, nil
 }
 
-func (pg *PostgresBookStore) GetBooks() ([]Book, error) {
-	var books []Book
+// availabilityHaving filters grouped book rows on whether a copy is on the shelf.
+func availabilityHaving(available *bool) string {
+	if available == nil {
+		return ""
+	}
+	if *available {
+		return `HAVING COUNT(items.id) FILTER (WHERE items.status = 'available') > 0`
+	}
+	return `HAVING COUNT(items.id) FILTER (WHERE items.status = 'available') = 0`
+}
 
-	query := `
-		SELECT id, title, author, summary, created_at, updated_at FROM books
-	`
+func (pg *PostgresBookStore) GetBooks(params BookListParams) (*Page[Book], error) {
+	key, ok := bookSortKeys[params.Sort]
+	if !ok {
+		return nil, ErrInvalidSort
+	}
 
-	rows, err := pg.db.Query(query)
-	if err == sql.ErrNoRows {
-		return nil, nil
+	var conditions []string
+	var args []any
+
+	if params.Author != "" {
+		args = append(args, params.Author)
+		conditions = append(conditions, fmt.Sprintf("LOWER(books.author) = LOWER($%d)", len(args)))
+	}
+
+	having := availabilityHaving(params.Available)
+	filtered := len(conditions) > 0 || having != ""
+	countQuery := `SELECT COUNT(*) FROM (SELECT books.id FROM books LEFT JOIN items ON items.book_id = books.id ` +
+		whereClause(conditions) + ` GROUP BY books.id ` + having + `) filtered`
+	countArgs := args
+
+	keyset, args := keysetCondition(params.ListParams, key, "books.id", args)
+	if keyset != "" {
+		conditions = append(conditions, keyset)
 	}
 
+	args = append(args, params.Limit+1)
+	query := bookSelect + whereClause(conditions) + `
+		GROUP BY books.id
+		` + having + `
+		` + orderBy(params.ListParams, key, "books.id") + fmt.Sprintf(" LIMIT $%d", len(args))
+
+	rows, err := pg.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
+	page := &Page[Book]{Items: []Book{}}
 	for rows.Next() {
 		var book Book
-		err := rows.Scan(
-			&book.ID, &book.Title, &book.Author, &book.Summary, &book.CreatedAt, &book.UpdatedAt,
-		)
+		err := scanBook(rows, &book)
 		if err != nil {
 			return nil, err
 		}
-		books = append(books, book)
+		page.Items = append(page.Items, book)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return books, nil
+	if len(page.Items) > params.Limit {
+		page.Items = page.Items[:params.Limit]
+		last := page.Items[len(page.Items)-1]
+		page.NextCursor = &Cursor{Sort: params.Sort, ID: int64(last.ID)}
+		switch params.Sort {
+		case "title":
+			page.NextCursor.Value = last.Title
+		case "author":
+			page.NextCursor.Value = last.Author
+		case "created_at":
+			page.NextCursor.Value = last.CreatedAt.UTC().Format(time.RFC3339Nano)
+		}
+	}
+
+	if filtered {
+		err = pg.db.QueryRow(countQuery, countArgs...).Scan(&page.TotalEstimate)
+	} else {
+		page.TotalEstimate, err = estimateRows(pg.db, "books")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
 }
 
 func (pg *PostgresBookStore) GetBookByID(id int64) (*Book, error) {
 	book := &Book{}
 
-	query := `
-		SELECT id, title, author, summary, created_at, updated_at FROM books
-		WHERE id = $1
+	query := bookSelect + `
+		WHERE books.id = $1
+		GROUP BY books.id
 	`
 
-	err := pg.db.QueryRow(query, id).Scan(&book.ID, &book.Title, &book.Author, &book.Summary, &book.CreatedAt, &book.UpdatedAt)
+	err := scanBook(pg.db.QueryRow(query, id), book)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -116,11 +240,11 @@ func (pg *PostgresBookStore) UpdateBook(book *Book) error {
 
 	query := `
 		UPDATE books
-		SET title = $1, author = $2, summary = $3
-		WHERE id = $4
+		SET title = $1, author = $2, summary = $3, category = $4
+		WHERE id = $5
 	`
 
-	result, err := tx.Exec(query, book.Title, book.Author, book.Summary, book.ID)
+	result, err := tx.Exec(query, book.Title, book.Author, book.Summary, book.Category, book.ID)
 	if err != nil {
 		return err
 	}
@@ -137,89 +261,236 @@ func (pg *PostgresBookStore) UpdateBook(book *Book) error {
 	return tx.Commit()
 }
 
+// DeleteBook refuses books that have ever been lent, since their loans
+// carry the fines and payments history of the patrons who borrowed them.
 func (pg *PostgresBookStore) DeleteBook(id int64) error {
-	query := `
-		DELETE from books
-		WHERE id = $1
-	`
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	result, err := pg.db.Exec(query, id)
+	err = tx.QueryRow(`SELECT id FROM books WHERE id = $1 FOR UPDATE`, id).Scan(&id)
 	if err != nil {
 		return err
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	var hasLoans bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM borrows_returns WHERE book_id = $1)`, id).Scan(&hasLoans)
 	if err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return sql.ErrNoRows
+	if hasLoans {
+		return ErrBookHasLoans
 	}
 
-	return nil
+	_, err = tx.Exec(`DELETE FROM books WHERE id = $1`, id)
+	if isForeignKeyViolation(err) {
+		return ErrBookHasLoans
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (pg *PostgresBookStore) BorrowBook(bookID int64, userID int64) (error) {
+// BorrowBook checks the copy out to the patron. A patron whose hold is ready
+// gets the copy set aside for them, as long as it is still on the hold shelf;
+// everybody else, or a holder whose copy has gone, gets the first copy on the
+// shelf. SKIP LOCKED lets two patrons borrowing the same title at once end up
+// with different copies instead of queueing behind each other's row lock.
+func (pg *PostgresBookStore) BorrowBook(bookID int64, userID int64, loanPeriod time.Duration) (*Loan, error) {
 	tx, err := pg.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
 
+	loan := &Loan{
+		BookID: int(bookID),
+		UserID: int(userID),
+	}
+
+	readyHoldQuery := `
+		SELECT holds.item_id FROM holds
+		INNER JOIN items ON items.id = holds.item_id
+		WHERE holds.book_id = $1 AND holds.user_id = $2 AND holds.status = 'ready'
+			AND holds.expires_at > CURRENT_TIMESTAMP AND items.status = 'on_hold'
+		FOR UPDATE
+	`
+
+	err = tx.QueryRow(readyHoldQuery, bookID, userID).Scan(&loan.ItemID)
+	if err == sql.ErrNoRows {
+		err = pg.claimShelfCopy(tx, bookID, loan)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	fulfillQuery := `
+		UPDATE holds
+		SET status = 'fulfilled'
+		WHERE book_id = $1 AND user_id = $2 AND status IN ('waiting', 'ready')
+	`
+
+	_, err = tx.Exec(fulfillQuery, bookID, userID)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
-		INSERT INTO borrows_returns (book_id, user_id)
-		VALUES ($1, $2)
+		INSERT INTO borrows_returns (book_id, item_id, user_id, borrowed_at, due_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP + make_interval(secs => $4))
+		RETURNING id, borrowed_at, due_at
 	`
-	_, err = tx.Exec(query, bookID, userID)
+
+	err = tx.QueryRow(query, bookID, loan.ItemID, userID, loanPeriod.Seconds()).Scan(&loan.ID, &loan.BorrowedAt, &loan.DueAt)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	updateQuery := `
-		UPDATE books
-		SET availability_status = 'borrowed'
+		UPDATE items
+		SET status = 'on_loan', updated_at = CURRENT_TIMESTAMP
 		WHERE id = $1
 	`
 
-	_, err = tx.Exec(updateQuery, bookID, userID)
+	_, err = tx.Exec(updateQuery, loan.ItemID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return loan, nil
+}
+
+func (pg *PostgresBookStore) claimShelfCopy(tx *sql.Tx, bookID int64, loan *Loan) error {
+	itemQuery := `
+		SELECT id FROM items
+		WHERE book_id = $1 AND status = 'available'
+		ORDER BY id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	`
+
+	err := tx.QueryRow(itemQuery, bookID).Scan(&loan.ItemID)
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	var bookExists bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM books WHERE id = $1)`, bookID).Scan(&bookExists)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if !bookExists {
+		return sql.ErrNoRows
+	}
+
+	return ErrBookUnavailable
+}
+
+// toPrefixTSQuery turns free text into a tsquery where every word is matched
+// as a prefix, so "harr pot" already finds "Harry Potter" while typing.
+// Anything other than letters and digits is dropped, which keeps user input
+// from reaching the tsquery parser as operators.
+func toPrefixTSQuery(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	if len(words) > 10 {
+		words = words[:10]
+	}
+
+	for i, word := range words {
+		words[i] = word + ":*"
+	}
+
+	return strings.Join(words, " & ")
 }
 
-func (pg *PostgresBookStore) CheckIsBookAvailable(bookID int64) (*string, error) {
-	return nil,nil
-	// tx, err := pg.db.Begin()
-	// if err != nil {
-	// 	return err
-	// }
-	// defer tx.Rollback()
+// ts_headline copies the source text as is, so it marks matches with control
+// characters instead of tags; highlightHTML escapes everything else before
+// turning them into <mark> tags. The characters are stripped from the source
+// first so book text cannot forge a marker.
+const (
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+var highlightTags = strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>")
 
-	// var availabilityStatus string;
+func highlightHTML(headline string) string {
+	return highlightTags.Replace(html.EscapeString(headline))
+}
+
+func (pg *PostgresBookStore) SearchBooks(params BookSearchParams) ([]BookSearchResult, error) {
+	results := []BookSearchResult{}
 
-	// query := `SELECT availability_status FROM books WHERE $1`
-	// err = tx.QueryRow(query, bookID).Scan(&availabilityStatus)
-	// if err != nil {
-	// 	return nil, err
-	// }
+	tsQuery := toPrefixTSQuery(params.Query)
+	if tsQuery == "" {
+		return results, nil
+	}
 
-	// if availabilityStatus == "borrowed" {
-	// 	return 
-	// }
+	args := []any{tsQuery, highlightStart + highlightStop}
+	where := `books.search_vector @@ to_tsquery('english', $1)`
 
+	if params.Author != "" {
+		args = append(args, params.Author)
+		where += fmt.Sprintf(` AND LOWER(books.author) = LOWER($%d)`, len(args))
+	}
 
-	// err = tx.Commit()
-	// if err != nil {
-	// 	return err
-	// }
+	having := availabilityHaving(params.Available)
 
-	// return nil
-}
\ No newline at end of file
+	args = append(args, params.Limit)
+
+	// ts_rank's default weights put A (title) above B (author) above C (summary).
+	query := `
+		SELECT ` + bookColumns + `,
+			ts_rank(books.search_vector, to_tsquery('english', $1)) AS rank,
+			ts_headline('english', translate(books.title, $2, ''), to_tsquery('english', $1),
+				'StartSel="` + highlightStart + `", StopSel="` + highlightStop + `", HighlightAll=TRUE'),
+			ts_headline('english', translate(COALESCE(books.summary, ''), $2, ''), to_tsquery('english', $1),
+				'StartSel="` + highlightStart + `", StopSel="` + highlightStop + `", MaxWords=30, MinWords=10, MaxFragments=2')
+		FROM books
+		LEFT JOIN items ON items.book_id = books.id
+		WHERE ` + where + `
+		GROUP BY books.id
+		` + having + `
+		ORDER BY rank DESC, books.id
+		LIMIT $` + fmt.Sprint(len(args))
+
+	rows, err := pg.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result BookSearchResult
+		book := &result.Book
+		err := rows.Scan(
+			&book.ID, &book.Title, &book.Author, &book.Summary, &book.Category, &book.CopiesAvailable, &book.CopiesTotal, &book.CreatedAt, &book.UpdatedAt,
+			&result.Rank, &result.TitleHighlight, &result.SummarySnippet,
+		)
+		if err != nil {
+			return nil, err
+		}
+		book.Available = book.CopiesAvailable > 0
+		result.TitleHighlight = highlightHTML(result.TitleHighlight)
+		result.SummarySnippet = highlightHTML(result.SummarySnippet)
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
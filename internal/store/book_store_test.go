@@ -0,0 +1,163 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToPrefixTSQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"empty", "", ""},
+		{"only punctuation", " !?-- ", ""},
+		{"single word", "Harry", "harry:*"},
+		{"partial words", "harr pot", "harr:* & pot:*"},
+		{"extra whitespace", "  harry \t\n potter  ", "harry:* & potter:*"},
+		{"digits kept", "catch 22", "catch:* & 22:*"},
+		{"operators dropped", "harry | !potter & (stone) <-> x:*", "harry:* & potter:* & stone:* & x:*"},
+		{"quotes and backslashes dropped", `o'brien \ "dune"`, "o:* & brien:* & dune:*"},
+		{"non-latin letters kept", "Café Müller Толстой", "café:* & müller:* & толстой:*"},
+		{"capped at ten words", "a b c d e f g h i j k l", "a:* & b:* & c:* & d:* & e:* & f:* & g:* & h:* & i:* & j:*"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := toPrefixTSQuery(tt.text); got != tt.want {
+				t.Fatalf("toPrefixTSQuery(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHighlightHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		headline string
+		want     string
+	}{
+		{"plain", "Dune", "Dune"},
+		{"marked", "\x02Harry\x03 Potter", "<mark>Harry</mark> Potter"},
+		{"markup in the text", "<script>alert(\"x\")</script> \x02Dune\x03", "&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; <mark>Dune</mark>"},
+		{"tags spelled as marks", "<mark onmouseover=x>\x02Dune\x03</mark>", "&lt;mark onmouseover=x&gt;<mark>Dune</mark>&lt;/mark&gt;"},
+		{"entities", "Tom &amp; Jerry & \x02friends\x03", "Tom &amp;amp; Jerry &amp; <mark>friends</mark>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := highlightHTML(tt.headline); got != tt.want {
+				t.Fatalf("highlightHTML(%q) = %q, want %q", tt.headline, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchBooksEscapesHighlights(t *testing.T) {
+	db := newTestDB(t)
+
+	var bookID int
+	err := db.QueryRow(`
+		INSERT INTO books (title, author, summary, category)
+		VALUES ($1, 'Mallory', $2, 'general')
+		RETURNING id
+	`, "<img src=x onerror=alert(1)> Quixotic \x02Tales", "A <script>quixotic</script> summary").Scan(&bookID)
+	if err != nil {
+		t.Fatalf("insert book: %v", err)
+	}
+
+	results, err := NewPostgresBookStore(db).SearchBooks(BookSearchParams{Query: "quixotic", Limit: 5})
+	if err != nil {
+		t.Fatalf("SearchBooks: %v", err)
+	}
+
+	if len(results) != 1 || results[0].ID != bookID {
+		t.Fatalf("results = %+v, want only book %d", results, bookID)
+	}
+
+	// ts_headline may trim or respace the text, so only check that nothing
+	// but the highlight tags survives unescaped.
+	for name, snippet := range map[string]string{"TitleHighlight": results[0].TitleHighlight, "SummarySnippet": results[0].SummarySnippet} {
+		if !strings.Contains(snippet, "<mark>") {
+			t.Errorf("%s = %q, want a highlighted match", name, snippet)
+		}
+		if rest := strings.NewReplacer("<mark>", "", "</mark>", "").Replace(snippet); strings.ContainsAny(rest, "<>\x02\x03") {
+			t.Errorf("%s = %q, want all other markup escaped", name, snippet)
+		}
+	}
+}
+
+func TestDeleteBookWithLoansIsRefused(t *testing.T) {
+	db := newTestDB(t)
+	_, book, _ := seedLoan(t, db)
+
+	err := NewPostgresBookStore(db).DeleteBook(int64(book.ID))
+	if err != ErrBookHasLoans {
+		t.Fatalf("DeleteBook = %v, want ErrBookHasLoans", err)
+	}
+
+	var loans int
+	err = db.QueryRow(`SELECT COUNT(*) FROM borrows_returns WHERE book_id = $1`, book.ID).Scan(&loans)
+	if err != nil {
+		t.Fatalf("count loans: %v", err)
+	}
+
+	if loans != 1 {
+		t.Fatalf("loans after refused delete = %d, want 1", loans)
+	}
+}
+
+func TestBorrowBookWithReadyHold(t *testing.T) {
+	tests := []struct {
+		name      string
+		copyState string
+		spare     bool
+		wantErr   error
+		wantSpare bool
+	}{
+		{"copy on the hold shelf", "on_hold", true, nil, false},
+		{"copy lost, spare on the shelf", "lost", true, nil, true},
+		{"copy withdrawn, nothing on the shelf", "withdrawn", false, ErrBookUnavailable, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			holder, book, held := seedReadyHold(t, db)
+
+			// Bypasses UpdateItem's guard to simulate a copy that went
+			// missing from the hold shelf.
+			_, err := db.Exec(`UPDATE items SET status = $1 WHERE id = $2`, tt.copyState, held.ID)
+			if err != nil {
+				t.Fatalf("set copy status: %v", err)
+			}
+
+			spare := &Item{BookID: book.ID, Barcode: "B0002", Condition: "good", Status: "maintenance"}
+			if tt.spare {
+				spare.Status = "available"
+			}
+			err = NewPostgresItemStore(db).CreateItem(spare)
+			if err != nil {
+				t.Fatalf("create spare: %v", err)
+			}
+
+			loan, err := NewPostgresBookStore(db).BorrowBook(int64(book.ID), int64(holder.ID), 14*24*time.Hour)
+			if err != tt.wantErr {
+				t.Fatalf("BorrowBook err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			wantItem := held.ID
+			if tt.wantSpare {
+				wantItem = spare.ID
+			}
+			if loan.ItemID != wantItem {
+				t.Fatalf("loan.ItemID = %d, want %d", loan.ItemID, wantItem)
+			}
+		})
+	}
+}
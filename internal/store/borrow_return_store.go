@@ -1,6 +1,29 @@
 package store
 
-import "database/sql"
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrLoanReturned        = errors.New("loan has already been returned")
+	ErrRenewalLimitReached = errors.New("maximum number of renewals reached")
+	ErrBookOnHold          = errors.New("book has a waiting hold")
+)
+
+type Loan struct {
+	ID         int        `json:"id"`
+	BookID     int        `json:"book_id"`
+	ItemID     int        `json:"item_id"`
+	UserID     int        `json:"user_id"`
+	BorrowedAt time.Time  `json:"borrowed_at"`
+	DueAt      time.Time  `json:"due_at"`
+	ReturnedAt *time.Time `json:"returned_at"`
+	Renewals   int        `json:"renewals"`
+	OverdueAt  *time.Time `json:"overdue_at"`
+}
 
 type PostgresBorrowReturnStore struct {
 	db *sql.DB
@@ -11,42 +34,263 @@ func NewPostgresBorrowReturnStore(db *sql.DB) *PostgresBorrowReturnStore {
 }
 
 type BorrowBookStore interface {
-	BorrowBook(id int64) (*Book, error)
-	ReturnBook(id int64)
-	RenewBook(id int64) (*Book, error)
+	GetLoanByID(id int64) (*Loan, error)
+	ReturnBook(loanID int64, pickupWindow time.Duration) (*Loan, error)
+	RenewBook(loanID int64, loanPeriod time.Duration, maxRenewals int) (*Loan, error)
+	MarkOverdueLoans() (int64, error)
+	ListLoans(params LoanListParams) (*Page[Loan], error)
+}
+
+type LoanListParams struct {
+	ListParams
+	UserID *int64
+	BookID *int64
+	Status string
+}
+
+var loanSortKeys = map[string]sortKey{
+	"borrowed_at": {column: "borrowed_at", cast: "TIMESTAMPTZ"},
+	"due_at":      {column: "due_at", cast: "TIMESTAMPTZ"},
+}
+
+// loanStatusConditions maps the status filter accepted by ListLoans to SQL.
+var loanStatusConditions = map[string]string{
+	"open":     "returned_at IS NULL",
+	"returned": "returned_at IS NOT NULL",
+	"overdue":  "returned_at IS NULL AND due_at < CURRENT_TIMESTAMP",
+}
+
+const loanColumns = `id, book_id, item_id, user_id, borrowed_at, due_at, returned_at, renewals, overdue_at`
+
+func scanLoan(row interface{ Scan(...any) error }, loan *Loan) error {
+	return row.Scan(&loan.ID, &loan.BookID, &loan.ItemID, &loan.UserID, &loan.BorrowedAt, &loan.DueAt, &loan.ReturnedAt, &loan.Renewals, &loan.OverdueAt)
+}
+
+func (pg *PostgresBorrowReturnStore) GetLoanByID(id int64) (*Loan, error) {
+	loan := &Loan{}
+
+	query := `SELECT ` + loanColumns + ` FROM borrows_returns WHERE id = $1`
+
+	err := scanLoan(pg.db.QueryRow(query, id), loan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return loan, nil
 }
 
-func (pg *PostgresBorrowReturnStore) BorrowBook(bookID int64, userID int64) (error) {
+func (pg *PostgresBorrowReturnStore) ReturnBook(loanID int64, pickupWindow time.Duration) (*Loan, error) {
 	tx, err := pg.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
 
-	query := `
-		INSERT INTO borrows_returns (book_id, user_id)
-		VALUES ($1, $2)
-	`
-	_, err = tx.Exec(query, bookID, userID)
+	loan := &Loan{}
+	query := `SELECT ` + loanColumns + ` FROM borrows_returns WHERE id = $1 FOR UPDATE`
+
+	err = scanLoan(tx.QueryRow(query, loanID), loan)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if loan.ReturnedAt != nil {
+		return nil, ErrLoanReturned
 	}
 
 	updateQuery := `
-		UPDATE books
-		SET availability_status = 'borrowed'
+		UPDATE borrows_returns
+		SET returned_at = CURRENT_TIMESTAMP
 		WHERE id = $1
+		RETURNING returned_at
 	`
 
-	_, err = tx.Exec(updateQuery, bookID, userID)
+	err = tx.QueryRow(updateQuery, loanID).Scan(&loan.ReturnedAt)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	_, err = accrueFines(tx, `borrows_returns.id = $1`, loan.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = releaseItem(tx, loan.ItemID, loan.BookID, pickupWindow)
+	if err != nil {
+		return nil, err
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return loan, nil
+}
+
+func (pg *PostgresBorrowReturnStore) RenewBook(loanID int64, loanPeriod time.Duration, maxRenewals int) (*Loan, error) {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	loan := &Loan{}
+	query := `SELECT ` + loanColumns + ` FROM borrows_returns WHERE id = $1 FOR UPDATE`
+
+	err = scanLoan(tx.QueryRow(query, loanID), loan)
+	if err != nil {
+		return nil, err
+	}
+
+	if loan.ReturnedAt != nil {
+		return nil, ErrLoanReturned
+	}
+
+	if loan.Renewals >= maxRenewals {
+		return nil, ErrRenewalLimitReached
+	}
+
+	var hasWaitingHold bool
+	holdQuery := `SELECT EXISTS (SELECT 1 FROM holds WHERE book_id = $1 AND status = 'waiting')`
+
+	err = tx.QueryRow(holdQuery, loan.BookID).Scan(&hasWaitingHold)
+	if err != nil {
+		return nil, err
+	}
+
+	if hasWaitingHold {
+		return nil, ErrBookOnHold
+	}
+
+	// Bill any lateness so far before due_at moves past it.
+	_, err = accrueFines(tx, `borrows_returns.id = $1`, loan.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	updateQuery := `
+		UPDATE borrows_returns
+		SET due_at = GREATEST(due_at, CURRENT_TIMESTAMP) + make_interval(secs => $1),
+			renewals = renewals + 1,
+			overdue_at = NULL
+		WHERE id = $2
+		RETURNING due_at, renewals, overdue_at
+	`
+
+	err = tx.QueryRow(updateQuery, loanPeriod.Seconds(), loanID).Scan(&loan.DueAt, &loan.Renewals, &loan.OverdueAt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return loan, nil
+}
+
+func (pg *PostgresBorrowReturnStore) MarkOverdueLoans() (int64, error) {
+	query := `
+		UPDATE borrows_returns
+		SET overdue_at = CURRENT_TIMESTAMP
+		WHERE returned_at IS NULL AND overdue_at IS NULL AND due_at < CURRENT_TIMESTAMP
+	`
+
+	result, err := pg.db.Exec(query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (pg *PostgresBorrowReturnStore) ListLoans(params LoanListParams) (*Page[Loan], error) {
+	key, ok := loanSortKeys[params.Sort]
+	if !ok {
+		return nil, ErrInvalidSort
+	}
+
+	var conditions []string
+	var args []any
+
+	if params.UserID != nil {
+		args = append(args, *params.UserID)
+		conditions = append(conditions, fmt.Sprintf("user_id = $%d", len(args)))
+	}
+
+	if params.BookID != nil {
+		args = append(args, *params.BookID)
+		conditions = append(conditions, fmt.Sprintf("book_id = $%d", len(args)))
+	}
+
+	if params.Status != "" {
+		condition, ok := loanStatusConditions[params.Status]
+		if !ok {
+			return nil, ErrInvalidFilter
+		}
+		conditions = append(conditions, condition)
+	}
+
+	filtered := len(conditions) > 0
+	countQuery := `SELECT COUNT(*) FROM borrows_returns ` + whereClause(conditions)
+	countArgs := args
+
+	keyset, args := keysetCondition(params.ListParams, key, "id", args)
+	if keyset != "" {
+		conditions = append(conditions, keyset)
+	}
+
+	args = append(args, params.Limit+1)
+	query := `SELECT ` + loanColumns + ` FROM borrows_returns ` + whereClause(conditions) + `
+		` + orderBy(params.ListParams, key, "id") + fmt.Sprintf(" LIMIT $%d", len(args))
+
+	rows, err := pg.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &Page[Loan]{Items: []Loan{}}
+	for rows.Next() {
+		var loan Loan
+		err := scanLoan(rows, &loan)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, loan)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Items) > params.Limit {
+		page.Items = page.Items[:params.Limit]
+		last := page.Items[len(page.Items)-1]
+		page.NextCursor = &Cursor{Sort: params.Sort, ID: int64(last.ID)}
+		switch params.Sort {
+		case "borrowed_at":
+			page.NextCursor.Value = last.BorrowedAt.UTC().Format(time.RFC3339Nano)
+		case "due_at":
+			page.NextCursor.Value = last.DueAt.UTC().Format(time.RFC3339Nano)
+		}
+	}
+
+	if filtered {
+		err = pg.db.QueryRow(countQuery, countArgs...).Scan(&page.TotalEstimate)
+	} else {
+		page.TotalEstimate, err = estimateRows(pg.db, "borrows_returns")
+	}
+
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return page, nil
 }
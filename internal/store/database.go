@@ -1,16 +1,22 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io/fs"
+	"path"
+	"strconv"
+	"strings"
 
+	"github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/pressly/goose/v3"
 )
 
-func Open() (*sql.DB, error) {
-	db, err := sql.Open("pgx", "host=localhost user=postgres password=postgres dbname=postgres port=5434 sslmode=disable")
+func Open(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("pgx", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("db: open %w", err)
 	}
@@ -18,8 +24,6 @@ func Open() (*sql.DB, error) {
 	if err := db.Ping(); err != nil {
 		return nil, fmt.Errorf("db: open %w", err)
 	}
-
-	fmt.Println("successfully connected to db")
 	return db, nil
 }
 
@@ -45,3 +49,56 @@ func Migrate(db *sql.DB, dir string) error {
 
 	return nil
 }
+
+// PendingMigrations lists the versions in migrationFS that goose has not yet
+// applied to db, so a running instance can tell it is behind the schema it
+// was built for.
+func PendingMigrations(ctx context.Context, db *sql.DB, migrationFS fs.FS, dir string) ([]int64, error) {
+	files, err := fs.Glob(migrationFS, path.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, fmt.Errorf("pending migrations: %w", err)
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT version_id FROM goose_db_version WHERE is_applied`)
+	if err != nil {
+		return nil, fmt.Errorf("pending migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := map[int64]bool{}
+	for rows.Next() {
+		var version int64
+		err = rows.Scan(&version)
+		if err != nil {
+			return nil, fmt.Errorf("pending migrations: %w", err)
+		}
+		applied[version] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("pending migrations: %w", err)
+	}
+
+	pending := []int64{}
+	for _, file := range files {
+		prefix, _, _ := strings.Cut(path.Base(file), "_")
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			continue
+		}
+		if !applied[version] {
+			pending = append(pending, version)
+		}
+	}
+
+	return pending, nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503"
+}
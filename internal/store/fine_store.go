@@ -0,0 +1,257 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrPaymentExceedsBalance = errors.New("payment exceeds outstanding balance")
+
+type Fine struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`
+	LoanID      int       `json:"loan_id"`
+	BookTitle   string    `json:"book_title"`
+	DaysOverdue int       `json:"days_overdue"`
+	AmountCents int       `json:"amount_cents"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type Payment struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`
+	AmountCents int       `json:"amount_cents"`
+	Kind        string    `json:"kind"`
+	Note        string    `json:"note"`
+	RecordedBy  *int      `json:"recorded_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type PostgresFineStore struct {
+	db *sql.DB
+}
+
+func NewPostgresFineStore(db *sql.DB) *PostgresFineStore {
+	return &PostgresFineStore{db: db}
+}
+
+type FineStore interface {
+	AccrueOverdueFines() (int64, error)
+	GetBalance(userID int64) (int, error)
+	GetFinesForUser(userID int64) ([]Fine, error)
+	GetPaymentsForUser(userID int64) ([]Payment, error)
+	RecordPayment(*Payment) error
+	SetDailyRates(rates map[string]int) error
+}
+
+// accrueFinesQuery charges every late loan matched by the filter for the
+// whole days it has been late since it was last charged, at its category's
+// daily rate, falling back to the "general" rate. Each loan keeps one fine
+// row that only ever grows: charged_through records how far the lateness has
+// been billed, so a renewal that moves due_at forward cannot undo a charge,
+// and re-running the query inside the same day adds nothing. The conflict
+// guard skips the update when a concurrent run has already billed past the
+// start of this run's period.
+const accrueFinesQuery = `
+	INSERT INTO fines (user_id, loan_id, days_overdue, amount_cents, charged_through)
+	SELECT late.user_id, late.id, late.days_overdue,
+		late.days_overdue * COALESCE(category_rate.daily_rate_cents, default_rate.daily_rate_cents, 0),
+		late.charge_from + make_interval(days => late.days_overdue)
+	FROM (
+		SELECT charging.*,
+			FLOOR(EXTRACT(EPOCH FROM charging.charge_until - charging.charge_from) / 86400)::INT AS days_overdue
+		FROM (
+			SELECT borrows_returns.id, borrows_returns.user_id, books.category,
+				GREATEST(borrows_returns.due_at, fines.charged_through) AS charge_from,
+				COALESCE(borrows_returns.returned_at, CURRENT_TIMESTAMP) AS charge_until
+			FROM borrows_returns
+			INNER JOIN books ON books.id = borrows_returns.book_id
+			LEFT JOIN fines ON fines.loan_id = borrows_returns.id
+			WHERE %s
+		) charging
+	) late
+	LEFT JOIN fine_rates category_rate ON category_rate.category = late.category
+	LEFT JOIN fine_rates default_rate ON default_rate.category = 'general'
+	WHERE late.days_overdue > 0
+	ON CONFLICT (loan_id) DO UPDATE
+	SET days_overdue = fines.days_overdue + EXCLUDED.days_overdue,
+		amount_cents = fines.amount_cents + EXCLUDED.amount_cents,
+		charged_through = EXCLUDED.charged_through,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE fines.charged_through <= EXCLUDED.charged_through - make_interval(days => EXCLUDED.days_overdue)
+`
+
+func accrueFines(exec interface {
+	Exec(string, ...any) (sql.Result, error)
+}, filter string, args ...any) (int64, error) {
+	result, err := exec.Exec(fmt.Sprintf(accrueFinesQuery, filter), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (pg *PostgresFineStore) AccrueOverdueFines() (int64, error) {
+	return accrueFines(pg.db, `borrows_returns.returned_at IS NULL AND borrows_returns.due_at < CURRENT_TIMESTAMP`)
+}
+
+// SetDailyRates upserts the configured per-category rates. Categories absent
+// from rates keep whatever the database already holds.
+func (pg *PostgresFineStore) SetDailyRates(rates map[string]int) error {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO fine_rates (category, daily_rate_cents)
+		VALUES ($1, $2)
+		ON CONFLICT (category) DO UPDATE
+		SET daily_rate_cents = EXCLUDED.daily_rate_cents, updated_at = CURRENT_TIMESTAMP
+		WHERE fine_rates.daily_rate_cents <> EXCLUDED.daily_rate_cents
+	`
+
+	for category, cents := range rates {
+		_, err = tx.Exec(query, category, cents)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetBalance brings the user's open loans up to date before summing, so the
+// balance never lags behind the last accrual run.
+func (pg *PostgresFineStore) GetBalance(userID int64) (int, error) {
+	_, err := accrueFines(pg.db, `borrows_returns.user_id = $1 AND borrows_returns.returned_at IS NULL AND borrows_returns.due_at < CURRENT_TIMESTAMP`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return outstandingBalance(pg.db, userID)
+}
+
+func outstandingBalance(q interface {
+	QueryRow(string, ...any) *sql.Row
+}, userID int64) (int, error) {
+	var balance int
+
+	query := `
+		SELECT
+			COALESCE((SELECT SUM(amount_cents) FROM fines WHERE user_id = $1), 0) -
+			COALESCE((SELECT SUM(amount_cents) FROM payments WHERE user_id = $1), 0)
+	`
+
+	err := q.QueryRow(query, userID).Scan(&balance)
+	if err != nil {
+		return 0, err
+	}
+
+	return balance, nil
+}
+
+func (pg *PostgresFineStore) GetFinesForUser(userID int64) ([]Fine, error) {
+	fines := []Fine{}
+
+	query := `
+		SELECT fines.id, fines.user_id, fines.loan_id, books.title, fines.days_overdue, fines.amount_cents, fines.created_at, fines.updated_at
+		FROM fines
+		INNER JOIN borrows_returns ON borrows_returns.id = fines.loan_id
+		INNER JOIN books ON books.id = borrows_returns.book_id
+		WHERE fines.user_id = $1
+		ORDER BY fines.created_at
+	`
+
+	rows, err := pg.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var fine Fine
+		err := rows.Scan(&fine.ID, &fine.UserID, &fine.LoanID, &fine.BookTitle, &fine.DaysOverdue, &fine.AmountCents, &fine.CreatedAt, &fine.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		fines = append(fines, fine)
+	}
+
+	return fines, rows.Err()
+}
+
+func (pg *PostgresFineStore) GetPaymentsForUser(userID int64) ([]Payment, error) {
+	payments := []Payment{}
+
+	query := `
+		SELECT id, user_id, amount_cents, kind, note, recorded_by, created_at
+		FROM payments
+		WHERE user_id = $1
+		ORDER BY created_at
+	`
+
+	rows, err := pg.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var payment Payment
+		err := rows.Scan(&payment.ID, &payment.UserID, &payment.AmountCents, &payment.Kind, &payment.Note, &payment.RecordedBy, &payment.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+
+	return payments, rows.Err()
+}
+
+// RecordPayment locks the patron row so two desks cannot both settle the
+// same balance, and refuses anything that would leave the account in credit.
+func (pg *PostgresFineStore) RecordPayment(payment *Payment) error {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`SELECT id FROM users WHERE id = $1 FOR NO KEY UPDATE`, payment.UserID).Scan(&payment.UserID)
+	if err != nil {
+		return err
+	}
+
+	_, err = accrueFines(tx, `borrows_returns.user_id = $1 AND borrows_returns.returned_at IS NULL AND borrows_returns.due_at < CURRENT_TIMESTAMP`, payment.UserID)
+	if err != nil {
+		return err
+	}
+
+	outstanding, err := outstandingBalance(tx, int64(payment.UserID))
+	if err != nil {
+		return err
+	}
+
+	if payment.AmountCents > outstanding {
+		return ErrPaymentExceedsBalance
+	}
+
+	query := `
+		INSERT INTO payments (user_id, amount_cents, kind, note, recorded_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+
+	err = tx.QueryRow(query, payment.UserID, payment.AmountCents, payment.Kind, payment.Note, payment.RecordedBy).Scan(&payment.ID, &payment.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
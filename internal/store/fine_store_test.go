@@ -0,0 +1,75 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenewingOverdueLoanKeepsFines(t *testing.T) {
+	db := newTestDB(t)
+	fineStore := NewPostgresFineStore(db)
+	loanStore := NewPostgresBorrowReturnStore(db)
+
+	err := fineStore.SetDailyRates(map[string]int{"general": 25})
+	if err != nil {
+		t.Fatalf("set rates: %v", err)
+	}
+
+	user, _, loan := seedLoan(t, db)
+
+	setDueAt := func(ago string) {
+		t.Helper()
+		_, err := db.Exec(`UPDATE borrows_returns SET due_at = CURRENT_TIMESTAMP - $1::INTERVAL WHERE id = $2`, ago, loan.ID)
+		if err != nil {
+			t.Fatalf("set due_at: %v", err)
+		}
+	}
+
+	balance := func() int {
+		t.Helper()
+		cents, err := fineStore.GetBalance(int64(user.ID))
+		if err != nil {
+			t.Fatalf("balance: %v", err)
+		}
+		return cents
+	}
+
+	// Three days late and never accrued: renewing must bill those days
+	// before due_at moves forward.
+	setDueAt("3 days 1 hour")
+
+	_, err = loanStore.RenewBook(int64(loan.ID), 14*24*time.Hour, 3)
+	if err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+
+	if got := balance(); got != 75 {
+		t.Fatalf("balance after renewal = %d, want 75", got)
+	}
+
+	// Fifteen days on the renewed loan is one day late again: the new
+	// lateness adds to the ledger instead of replacing the larger earlier
+	// charge.
+	_, err = db.Exec(`UPDATE borrows_returns SET due_at = due_at - INTERVAL '15 days' WHERE id = $1`, loan.ID)
+	if err != nil {
+		t.Fatalf("shift due_at: %v", err)
+	}
+
+	_, err = db.Exec(`UPDATE fines SET charged_through = charged_through - INTERVAL '15 days' WHERE loan_id = $1`, loan.ID)
+	if err != nil {
+		t.Fatalf("shift charged_through: %v", err)
+	}
+
+	if got := balance(); got != 100 {
+		t.Fatalf("balance after second lateness = %d, want 100", got)
+	}
+
+	_, err = fineStore.AccrueOverdueFines()
+	if err != nil {
+		t.Fatalf("accrue: %v", err)
+	}
+
+	if got := balance(); got != 100 {
+		t.Fatalf("balance after re-running accrual = %d, want 100", got)
+	}
+}
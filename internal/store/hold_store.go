@@ -0,0 +1,263 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrDuplicateHold = errors.New("user already has an active hold on this book")
+	ErrBookAvailable = errors.New("book has copies available")
+)
+
+type Hold struct {
+	ID        int        `json:"id"`
+	BookID    int        `json:"book_id"`
+	BookTitle string     `json:"book_title,omitempty"`
+	UserID    int        `json:"user_id"`
+	ItemID    *int       `json:"item_id"`
+	Status    string     `json:"status"`
+	Position  int        `json:"queue_position,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadyAt   *time.Time `json:"ready_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type PostgresHoldStore struct {
+	db *sql.DB
+}
+
+func NewPostgresHoldStore(db *sql.DB) *PostgresHoldStore {
+	return &PostgresHoldStore{db: db}
+}
+
+type HoldStore interface {
+	CreateHold(bookID int64, userID int64) (*Hold, error)
+	GetActiveHoldsForUser(userID int64) ([]Hold, error)
+	ExpireStaleHolds(pickupWindow time.Duration) (int64, error)
+}
+
+// releaseItem puts a copy that just came back into circulation. If anyone is
+// waiting for the book the oldest hold becomes ready for pickup and the copy
+// is set aside for it; otherwise the copy goes back on the shelf.
+func releaseItem(tx *sql.Tx, itemID int, bookID int, pickupWindow time.Duration) error {
+	_, err := tx.Exec(`SELECT id FROM books WHERE id = $1 FOR NO KEY UPDATE`, bookID)
+	if err != nil {
+		return err
+	}
+
+	var holdID int
+	holdQuery := `
+		SELECT id FROM holds
+		WHERE book_id = $1 AND status = 'waiting'
+		ORDER BY created_at, id
+		LIMIT 1
+		FOR UPDATE
+	`
+
+	err = tx.QueryRow(holdQuery, bookID).Scan(&holdID)
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec(`UPDATE items SET status = 'available', updated_at = CURRENT_TIMESTAMP WHERE id = $1`, itemID)
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	readyQuery := `
+		UPDATE holds
+		SET status = 'ready', item_id = $1, ready_at = CURRENT_TIMESTAMP,
+			expires_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+		WHERE id = $3
+	`
+
+	_, err = tx.Exec(readyQuery, itemID, pickupWindow.Seconds(), holdID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE items SET status = 'on_hold', updated_at = CURRENT_TIMESTAMP WHERE id = $1`, itemID)
+	return err
+}
+
+func (pg *PostgresHoldStore) CreateHold(bookID int64, userID int64) (*Hold, error) {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the book serialises this check against releaseItem, so a copy
+	// cannot come back between counting the shelf and joining the queue.
+	err = tx.QueryRow(`SELECT id FROM books WHERE id = $1 FOR NO KEY UPDATE`, bookID).Scan(&bookID)
+	if err != nil {
+		return nil, err
+	}
+
+	var copiesAvailable int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM items WHERE book_id = $1 AND status = 'available'`, bookID).Scan(&copiesAvailable)
+	if err != nil {
+		return nil, err
+	}
+
+	if copiesAvailable > 0 {
+		return nil, ErrBookAvailable
+	}
+
+	hold := &Hold{
+		BookID: int(bookID),
+		UserID: int(userID),
+	}
+
+	query := `
+		INSERT INTO holds (book_id, user_id)
+		VALUES ($1, $2)
+		RETURNING id, status, created_at
+	`
+
+	err = tx.QueryRow(query, bookID, userID).Scan(&hold.ID, &hold.Status, &hold.CreatedAt)
+	if isUniqueViolation(err) {
+		return nil, ErrDuplicateHold
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(`SELECT COUNT(*) FROM holds WHERE book_id = $1 AND status = 'waiting'`, bookID).Scan(&hold.Position)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+func (pg *PostgresHoldStore) GetActiveHoldsForUser(userID int64) ([]Hold, error) {
+	holds := []Hold{}
+
+	query := `
+		SELECT holds.id, holds.book_id, books.title, holds.user_id, holds.item_id, holds.status,
+			CASE WHEN holds.status = 'waiting' THEN (
+				SELECT COUNT(*) FROM holds ahead
+				WHERE ahead.book_id = holds.book_id AND ahead.status = 'waiting'
+					AND (ahead.created_at, ahead.id) <= (holds.created_at, holds.id)
+			) ELSE 0 END,
+			holds.created_at, holds.ready_at, holds.expires_at
+		FROM holds
+		INNER JOIN books ON books.id = holds.book_id
+		WHERE holds.user_id = $1 AND holds.status IN ('waiting', 'ready')
+		ORDER BY holds.created_at
+	`
+
+	rows, err := pg.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hold Hold
+		err := rows.Scan(&hold.ID, &hold.BookID, &hold.BookTitle, &hold.UserID, &hold.ItemID, &hold.Status, &hold.Position, &hold.CreatedAt, &hold.ReadyAt, &hold.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, hold)
+	}
+
+	return holds, rows.Err()
+}
+
+// ExpireStaleHolds expires ready holds whose pickup window has passed and
+// hands their copies to the next patron in line. It also fills waiting holds
+// from copies that reappeared on the shelf without going through a return,
+// e.g. an item coming back from maintenance.
+func (pg *PostgresHoldStore) ExpireStaleHolds(pickupWindow time.Duration) (int64, error) {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	expireQuery := `
+		UPDATE holds
+		SET status = 'expired'
+		WHERE id IN (
+			SELECT id FROM holds
+			WHERE status = 'ready' AND expires_at <= CURRENT_TIMESTAMP
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING item_id, book_id
+	`
+
+	released, expired, err := collectHeldItems(tx, expireQuery)
+	if err != nil {
+		return 0, err
+	}
+
+	shelfQuery := `
+		SELECT items.id, items.book_id FROM items
+		WHERE items.status = 'available' AND EXISTS (
+			SELECT 1 FROM holds WHERE holds.book_id = items.book_id AND holds.status = 'waiting'
+		)
+		FOR UPDATE SKIP LOCKED
+	`
+
+	onShelf, _, err := collectHeldItems(tx, shelfQuery)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, item := range append(released, onShelf...) {
+		err = releaseItem(tx, item.itemID, item.bookID, pickupWindow)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return expired, nil
+}
+
+type heldItem struct {
+	itemID int
+	bookID int
+}
+
+// collectHeldItems runs a query returning (item_id, book_id) rows and reports
+// how many rows it saw, including those whose item has since been deleted.
+func collectHeldItems(tx *sql.Tx, query string, args ...any) ([]heldItem, int64, error) {
+	var items []heldItem
+	var count int64
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var itemID sql.NullInt64
+		var bookID int
+		err := rows.Scan(&itemID, &bookID)
+		if err != nil {
+			return nil, 0, err
+		}
+		count++
+		if itemID.Valid {
+			items = append(items, heldItem{itemID: int(itemID.Int64), bookID: bookID})
+		}
+	}
+
+	return items, count, rows.Err()
+}
@@ -0,0 +1,194 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrDuplicateBarcode = errors.New("barcode already in use")
+	ErrItemOnLoan       = errors.New("item is on loan")
+	ErrItemOnHold       = errors.New("item is set aside for a hold")
+	ErrItemHasLoans     = errors.New("item has loan history")
+)
+
+type Item struct {
+	ID            int       `json:"id"`
+	BookID        int       `json:"book_id"`
+	Barcode       string    `json:"barcode"`
+	ShelfLocation string    `json:"shelf_location"`
+	Condition     string    `json:"condition"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type PostgresItemStore struct {
+	db *sql.DB
+}
+
+func NewPostgresItemStore(db *sql.DB) *PostgresItemStore {
+	return &PostgresItemStore{db: db}
+}
+
+type ItemStore interface {
+	CreateItem(*Item) error
+	GetItemsForBook(bookID int64) ([]Item, error)
+	GetItemByID(id int64) (*Item, error)
+	UpdateItem(*Item) error
+	DeleteItem(id int64) error
+}
+
+func (pg *PostgresItemStore) CreateItem(item *Item) error {
+	query := `
+		INSERT INTO items (book_id, barcode, shelf_location, condition, status)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, updated_at
+	`
+
+	err := pg.db.QueryRow(query, item.BookID, item.Barcode, item.ShelfLocation, item.Condition, item.Status).Scan(&item.ID, &item.CreatedAt, &item.UpdatedAt)
+	if isUniqueViolation(err) {
+		return ErrDuplicateBarcode
+	}
+
+	return err
+}
+
+func (pg *PostgresItemStore) GetItemsForBook(bookID int64) ([]Item, error) {
+	items := []Item{}
+
+	query := `
+		SELECT id, book_id, barcode, shelf_location, condition, status, created_at, updated_at
+		FROM items
+		WHERE book_id = $1
+		ORDER BY id
+	`
+
+	rows, err := pg.db.Query(query, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item Item
+		err := rows.Scan(&item.ID, &item.BookID, &item.Barcode, &item.ShelfLocation, &item.Condition, &item.Status, &item.CreatedAt, &item.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (pg *PostgresItemStore) GetItemByID(id int64) (*Item, error) {
+	item := &Item{}
+
+	query := `
+		SELECT id, book_id, barcode, shelf_location, condition, status, created_at, updated_at
+		FROM items
+		WHERE id = $1
+	`
+
+	err := pg.db.QueryRow(query, id).Scan(&item.ID, &item.BookID, &item.Barcode, &item.ShelfLocation, &item.Condition, &item.Status, &item.CreatedAt, &item.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// UpdateItem refuses to touch the status of a copy that is out on loan or
+// set aside for a ready hold; loans and holds move items in and out of
+// "on_loan" and "on_hold" themselves.
+func (pg *PostgresItemStore) UpdateItem(item *Item) error {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var currentStatus string
+	err = tx.QueryRow(`SELECT status FROM items WHERE id = $1 FOR UPDATE`, item.ID).Scan(&currentStatus)
+	if err != nil {
+		return err
+	}
+
+	if currentStatus == "on_loan" && item.Status != currentStatus {
+		return ErrItemOnLoan
+	}
+
+	if currentStatus == "on_hold" && item.Status != currentStatus {
+		return ErrItemOnHold
+	}
+
+	query := `
+		UPDATE items
+		SET barcode = $1, shelf_location = $2, condition = $3, status = $4, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $5
+		RETURNING updated_at
+	`
+
+	err = tx.QueryRow(query, item.Barcode, item.ShelfLocation, item.Condition, item.Status, item.ID).Scan(&item.UpdatedAt)
+	if isUniqueViolation(err) {
+		return ErrDuplicateBarcode
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteItem refuses copies with loan history, and copies set aside for a
+// ready hold, which would otherwise leave the hold waiting on nothing.
+func (pg *PostgresItemStore) DeleteItem(id int64) error {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(`SELECT status FROM items WHERE id = $1 FOR UPDATE`, id).Scan(&status)
+	if err != nil {
+		return err
+	}
+
+	if status == "on_hold" {
+		return ErrItemOnHold
+	}
+
+	var hasLoans bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM borrows_returns WHERE item_id = $1)`, id).Scan(&hasLoans)
+	if err != nil {
+		return err
+	}
+
+	if hasLoans {
+		return ErrItemHasLoans
+	}
+
+	result, err := tx.Exec(`DELETE FROM items WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,33 @@
+package store
+
+import "testing"
+
+func TestUpdateItemOnHold(t *testing.T) {
+	db := newTestDB(t)
+	_, _, item := seedReadyHold(t, db)
+	itemStore := NewPostgresItemStore(db)
+
+	item.ShelfLocation = "Hold shelf 3"
+	err := itemStore.UpdateItem(item)
+	if err != nil {
+		t.Fatalf("UpdateItem keeping on_hold: %v", err)
+	}
+
+	for _, status := range []string{"available", "maintenance", "lost", "withdrawn"} {
+		item.Status = status
+		err = itemStore.UpdateItem(item)
+		if err != ErrItemOnHold {
+			t.Fatalf("UpdateItem to %s = %v, want ErrItemOnHold", status, err)
+		}
+	}
+}
+
+func TestDeleteItemOnHoldIsRefused(t *testing.T) {
+	db := newTestDB(t)
+	_, _, item := seedReadyHold(t, db)
+
+	err := NewPostgresItemStore(db).DeleteItem(int64(item.ID))
+	if err != ErrItemOnHold {
+		t.Fatalf("DeleteItem = %v, want ErrItemOnHold", err)
+	}
+}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// ThrottlePolicy describes how quickly a subject is slowed down. The first
+// FreeFailures failures inside Window cost nothing; each one after that
+// locks the subject out for BaseDelay, doubling per further failure up to
+// MaxDelay. A failure after a quiet Window starts the count again.
+type ThrottlePolicy struct {
+	FreeFailures int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Window       time.Duration
+}
+
+func (p ThrottlePolicy) delay(failures int) time.Duration {
+	over := failures - p.FreeFailures
+	if over <= 0 {
+		return 0
+	}
+
+	d := p.BaseDelay
+	for i := 1; i < over && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, p.MaxDelay)
+}
+
+func IPThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+func UserThrottleKey(username string) string {
+	return "user:" + username
+}
+
+func TwoFactorThrottleKey(userID int) string {
+	return "2fa:" + strconv.Itoa(userID)
+}
+
+type PostgresLoginThrottleStore struct {
+	db *sql.DB
+}
+
+func NewPostgresLoginThrottleStore(db *sql.DB) *PostgresLoginThrottleStore {
+	return &PostgresLoginThrottleStore{
+		db: db,
+	}
+}
+
+type LoginThrottleStore interface {
+	LockedUntil(keys ...string) (*time.Time, error)
+	RecordFailure(key string, policy ThrottlePolicy) (*time.Time, error)
+	Reset(key string) error
+	UnlockUser(userID int64) error
+	DeleteStaleThrottles(window time.Duration) (int64, error)
+}
+
+// LockedUntil returns the latest lockout among keys that is still in force,
+// or nil when none of them is locked.
+func (pg *PostgresLoginThrottleStore) LockedUntil(keys ...string) (*time.Time, error) {
+	var lockedUntil sql.NullTime
+
+	query := `
+		SELECT MAX(locked_until) FROM login_throttles
+		WHERE key = ANY($1) AND locked_until > CURRENT_TIMESTAMP
+	`
+
+	err := pg.db.QueryRow(query, keys).Scan(&lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !lockedUntil.Valid {
+		return nil, nil
+	}
+
+	return &lockedUntil.Time, nil
+}
+
+// RecordFailure counts one failed attempt against key and applies the
+// policy's lockout, returning it when one is now in force.
+func (pg *PostgresLoginThrottleStore) RecordFailure(key string, policy ThrottlePolicy) (*time.Time, error) {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var failures int
+
+	query := `
+		INSERT INTO login_throttles (key, failures, last_failure_at)
+		VALUES ($1, 1, CURRENT_TIMESTAMP)
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE
+				WHEN login_throttles.last_failure_at < CURRENT_TIMESTAMP - make_interval(secs => $2) THEN 1
+				ELSE login_throttles.failures + 1
+			END,
+			last_failure_at = CURRENT_TIMESTAMP
+		RETURNING failures
+	`
+
+	err = tx.QueryRow(query, key, policy.Window.Seconds()).Scan(&failures)
+	if err != nil {
+		return nil, err
+	}
+
+	var lockedUntil *time.Time
+
+	if d := policy.delay(failures); d > 0 {
+		lockedUntil = &time.Time{}
+		err = tx.QueryRow(
+			`UPDATE login_throttles SET locked_until = CURRENT_TIMESTAMP + make_interval(secs => $2) WHERE key = $1 RETURNING locked_until`,
+			key, d.Seconds(),
+		).Scan(lockedUntil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return lockedUntil, nil
+}
+
+func (pg *PostgresLoginThrottleStore) Reset(key string) error {
+	_, err := pg.db.Exec(`DELETE FROM login_throttles WHERE key = $1`, key)
+	return err
+}
+
+// UnlockUser clears the username lockout for an account. It returns
+// sql.ErrNoRows when the user does not exist.
+func (pg *PostgresLoginThrottleStore) UnlockUser(userID int64) error {
+	var username string
+	err := pg.db.QueryRow(`SELECT username FROM users WHERE id = $1`, userID).Scan(&username)
+	if err != nil {
+		return err
+	}
+
+	return pg.Reset(UserThrottleKey(username))
+}
+
+// DeleteStaleThrottles forgets subjects that are not locked and have been
+// quiet for longer than window, since their count would restart anyway.
+func (pg *PostgresLoginThrottleStore) DeleteStaleThrottles(window time.Duration) (int64, error) {
+	query := `
+		DELETE FROM login_throttles
+		WHERE last_failure_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+		AND (locked_until IS NULL OR locked_until < CURRENT_TIMESTAMP)
+	`
+
+	result, err := pg.db.Exec(query, window.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
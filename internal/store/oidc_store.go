@@ -0,0 +1,116 @@
+package store
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"time"
+)
+
+// OIDCLoginState is what the login endpoint remembers about a redirect to
+// the identity provider, so the callback can finish the PKCE exchange and
+// check the ID token's nonce.
+type OIDCLoginState struct {
+	CodeVerifier string
+	Nonce        string
+}
+
+type PostgresOIDCStore struct {
+	db *sql.DB
+}
+
+func NewPostgresOIDCStore(db *sql.DB) *PostgresOIDCStore {
+	return &PostgresOIDCStore{
+		db: db,
+	}
+}
+
+type OIDCStore interface {
+	CreateLoginState(state string, loginState OIDCLoginState, ttl time.Duration) error
+	ConsumeLoginState(state string) (*OIDCLoginState, error)
+	DeleteExpiredLoginStates() (int64, error)
+	GetUserByIdentity(issuer, subject string) (*User, error)
+	LinkIdentity(userID int, issuer, subject, email string) error
+}
+
+func (pg *PostgresOIDCStore) CreateLoginState(state string, loginState OIDCLoginState, ttl time.Duration) error {
+	stateHash := sha256.Sum256([]byte(state))
+
+	query := `
+		INSERT INTO oidc_login_states (state_hash, code_verifier, nonce, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`
+
+	_, err := pg.db.Exec(query, stateHash[:], loginState.CodeVerifier, loginState.Nonce, time.Now().Add(ttl))
+	return err
+}
+
+// ConsumeLoginState returns and deletes the login state for state, so each
+// redirect can be completed only once. It returns nil when the state is
+// unknown, already used or expired.
+func (pg *PostgresOIDCStore) ConsumeLoginState(state string) (*OIDCLoginState, error) {
+	stateHash := sha256.Sum256([]byte(state))
+	loginState := &OIDCLoginState{}
+
+	query := `
+		DELETE FROM oidc_login_states
+		WHERE state_hash = $1 AND expires_at > CURRENT_TIMESTAMP
+		RETURNING code_verifier, nonce
+	`
+
+	err := pg.db.QueryRow(query, stateHash[:]).Scan(&loginState.CodeVerifier, &loginState.Nonce)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return loginState, nil
+}
+
+func (pg *PostgresOIDCStore) DeleteExpiredLoginStates() (int64, error) {
+	result, err := pg.db.Exec(`DELETE FROM oidc_login_states WHERE expires_at <= CURRENT_TIMESTAMP`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (pg *PostgresOIDCStore) GetUserByIdentity(issuer, subject string) (*User, error) {
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	query := `
+		SELECT users.id, users.username, users.email, users.password_hash, users.account_type, users.address, users.activated, users.two_factor_enabled, users.created_at, users.updated_at
+		FROM users
+		INNER JOIN user_identities ON user_identities.user_id = users.id
+		WHERE user_identities.issuer = $1 AND user_identities.subject = $2
+	`
+
+	err := pg.db.QueryRow(query, issuer, subject).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash.hash, &user.AccountType, &user.Address, &user.Activated, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// LinkIdentity ties the provider's subject to userID, or records another
+// login for a subject that is already linked.
+func (pg *PostgresOIDCStore) LinkIdentity(userID int, issuer, subject, email string) error {
+	query := `
+		INSERT INTO user_identities (issuer, subject, user_id, email)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (issuer, subject) DO UPDATE
+		SET email = EXCLUDED.email, last_login_at = CURRENT_TIMESTAMP
+	`
+
+	_, err := pg.db.Exec(query, issuer, subject, userID, email)
+	return err
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort")
+	ErrInvalidFilter = errors.New("invalid filter")
+)
+
+// Cursor marks the last row of a page. It carries the sort it was issued for
+// so a cursor cannot be replayed against a different ordering.
+type Cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+func (c *Cursor) Encode() string {
+	js, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func DecodeCursor(encoded string) (*Cursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	cursor := &Cursor{}
+	err = json.Unmarshal(js, cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return cursor, nil
+}
+
+type ListParams struct {
+	Limit      int
+	Sort       string
+	Descending bool
+	After      *Cursor
+}
+
+type Page[T any] struct {
+	Items         []T
+	NextCursor    *Cursor
+	TotalEstimate int64
+}
+
+// sortKey is a column a listing can be ordered by. cast is the Postgres
+// type the cursor's string value is converted to before comparing.
+type sortKey struct {
+	column string
+	cast   string
+}
+
+// keysetCondition returns the predicate that skips everything up to and
+// including the cursor row, using (sort column, id) so ties on the sort
+// column are still paged deterministically.
+func keysetCondition(params ListParams, key sortKey, idColumn string, args []any) (string, []any) {
+	if params.After == nil {
+		return "", args
+	}
+
+	operator := ">"
+	if params.Descending {
+		operator = "<"
+	}
+
+	args = append(args, params.After.Value, params.After.ID)
+	condition := fmt.Sprintf("(%s, %s) %s ($%d::%s, $%d)", key.column, idColumn, operator, len(args)-1, key.cast, len(args))
+	return condition, args
+}
+
+func orderBy(params ListParams, key sortKey, idColumn string) string {
+	direction := "ASC"
+	if params.Descending {
+		direction = "DESC"
+	}
+	return fmt.Sprintf("ORDER BY %s %s, %s %s", key.column, direction, idColumn, direction)
+}
+
+// estimateRows reads the planner's row estimate for an unfiltered table.
+// Statistics are missing or meaningless for small tables, so below a
+// threshold it falls back to an exact count.
+func estimateRows(db *sql.DB, table string) (int64, error) {
+	var estimate int64
+	err := db.QueryRow(`SELECT reltuples::BIGINT FROM pg_class WHERE relname = $1`, table).Scan(&estimate)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	if estimate >= 10000 {
+		return estimate, nil
+	}
+
+	err = db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&estimate)
+	return estimate, err
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conditions, " AND ")
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []Cursor{
+		{Sort: "title", Value: "Harry Potter", ID: 12},
+		{Sort: "created_at", Value: "2024-05-01T10:00:00.123456Z", ID: 1},
+		{Sort: "title", Value: "", ID: 0},
+		{Sort: "title", Value: `quotes " and \ slashes / and unicode Ω`, ID: 9007199254740993},
+	}
+
+	for _, cursor := range tests {
+		encoded := cursor.Encode()
+
+		decoded, err := DecodeCursor(encoded)
+		if err != nil {
+			t.Fatalf("DecodeCursor(%q): %v", encoded, err)
+		}
+		if !reflect.DeepEqual(*decoded, cursor) {
+			t.Fatalf("round trip = %+v, want %+v", *decoded, cursor)
+		}
+	}
+}
+
+func TestCursorEncodingIsURLSafe(t *testing.T) {
+	// This value encodes to "+" and "/" in standard base64.
+	encoded := (&Cursor{Sort: "title", Value: "~~~???>>>", ID: 1}).Encode()
+
+	for _, r := range encoded {
+		if r == '+' || r == '/' || r == '=' {
+			t.Fatalf("Encode() = %q, want URL-safe base64 without padding", encoded)
+		}
+	}
+}
+
+func TestDecodeCursorRejectsGarbage(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"not base64", "!!!"},
+		{"standard base64 with padding", base64.StdEncoding.EncodeToString([]byte(`{"s":"title"}`))},
+		{"not JSON", base64.RawURLEncoding.EncodeToString([]byte("title:12"))},
+		{"wrong field type", base64.RawURLEncoding.EncodeToString([]byte(`{"s":"title","v":"x","id":"12"}`))},
+		{"truncated", (&Cursor{Sort: "title", Value: "x", ID: 12}).Encode()[:10]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor, err := DecodeCursor(tt.encoded)
+			if err != ErrInvalidCursor {
+				t.Fatalf("DecodeCursor(%q) = %+v, %v; want ErrInvalidCursor", tt.encoded, cursor, err)
+			}
+		})
+	}
+}
+
+func TestKeysetCondition(t *testing.T) {
+	key := sortKey{column: "books.title", cast: "text"}
+	after := &Cursor{Sort: "title", Value: "Dune", ID: 7}
+
+	tests := []struct {
+		name      string
+		params    ListParams
+		args      []any
+		condition string
+		wantArgs  []any
+	}{
+		{"first page", ListParams{Sort: "title"}, []any{"x"}, "", []any{"x"}},
+		{"ascending", ListParams{Sort: "title", After: after}, nil, "(books.title, books.id) > ($1::text, $2)", []any{"Dune", int64(7)}},
+		{"descending", ListParams{Sort: "title", Descending: true, After: after}, nil, "(books.title, books.id) < ($1::text, $2)", []any{"Dune", int64(7)}},
+		{"after other args", ListParams{Sort: "title", After: after}, []any{"fiction"}, "(books.title, books.id) > ($2::text, $3)", []any{"fiction", "Dune", int64(7)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition, args := keysetCondition(tt.params, key, "books.id", tt.args)
+			if condition != tt.condition {
+				t.Errorf("condition = %q, want %q", condition, tt.condition)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestOrderBy(t *testing.T) {
+	key := sortKey{column: "books.title", cast: "text"}
+
+	if got, want := orderBy(ListParams{}, key, "books.id"), "ORDER BY books.title ASC, books.id ASC"; got != want {
+		t.Errorf("ascending = %q, want %q", got, want)
+	}
+	if got, want := orderBy(ListParams{Descending: true}, key, "books.id"), "ORDER BY books.title DESC, books.id DESC"; got != want {
+		t.Errorf("descending = %q, want %q", got, want)
+	}
+}
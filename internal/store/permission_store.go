@@ -0,0 +1,245 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrDuplicateRole     = errors.New("role already exists")
+	ErrRoleInUse         = errors.New("role is assigned to users")
+	ErrUnknownPermission = errors.New("unknown permission")
+	ErrProtectedRole     = errors.New("role is protected")
+)
+
+// ProtectedRoles cannot be deleted or have their permissions changed: every
+// new account starts as a patron, and admin must always be able to manage
+// the rest of the permission model.
+var ProtectedRoles = map[string]bool{
+	"patron": true,
+	"admin":  true,
+}
+
+type Role struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type Permission struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+type PostgresPermissionStore struct {
+	db *sql.DB
+}
+
+func NewPostgresPermissionStore(db *sql.DB) *PostgresPermissionStore {
+	return &PostgresPermissionStore{db: db}
+}
+
+type PermissionStore interface {
+	GetPermissionsForRole(role string) ([]string, error)
+	GetPermissions() ([]Permission, error)
+	GetRoles() ([]Role, error)
+	GetRole(name string) (*Role, error)
+	CreateRole(*Role) error
+	SetRolePermissions(role string, permissions []string) error
+	DeleteRole(name string) error
+}
+
+func (pg *PostgresPermissionStore) GetPermissionsForRole(role string) ([]string, error) {
+	permissions := []string{}
+
+	rows, err := pg.db.Query(`SELECT permission FROM role_permissions WHERE role = $1 ORDER BY permission`, role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	return permissions, rows.Err()
+}
+
+func (pg *PostgresPermissionStore) GetPermissions() ([]Permission, error) {
+	permissions := []Permission{}
+
+	rows, err := pg.db.Query(`SELECT code, description FROM permissions ORDER BY code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var permission Permission
+		err := rows.Scan(&permission.Code, &permission.Description)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	return permissions, rows.Err()
+}
+
+func (pg *PostgresPermissionStore) GetRoles() ([]Role, error) {
+	roles := []Role{}
+
+	rows, err := pg.db.Query(`SELECT name, description, created_at FROM roles ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var role Role
+		err := rows.Scan(&role.Name, &role.Description, &role.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range roles {
+		roles[i].Permissions, err = pg.GetPermissionsForRole(roles[i].Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return roles, nil
+}
+
+func (pg *PostgresPermissionStore) GetRole(name string) (*Role, error) {
+	role := &Role{}
+
+	err := pg.db.QueryRow(`SELECT name, description, created_at FROM roles WHERE name = $1`, name).Scan(&role.Name, &role.Description, &role.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	role.Permissions, err = pg.GetPermissionsForRole(role.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return role, nil
+}
+
+func (pg *PostgresPermissionStore) CreateRole(role *Role) error {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`INSERT INTO roles (name, description) VALUES ($1, $2) RETURNING created_at`, role.Name, role.Description).Scan(&role.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrDuplicateRole
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = insertRolePermissions(tx, role.Name, role.Permissions)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (pg *PostgresPermissionStore) SetRolePermissions(role string, permissions []string) error {
+	if ProtectedRoles[role] {
+		return ErrProtectedRole
+	}
+
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`SELECT name FROM roles WHERE name = $1 FOR UPDATE`, role).Scan(&role)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM role_permissions WHERE role = $1`, role)
+	if err != nil {
+		return err
+	}
+
+	err = insertRolePermissions(tx, role, permissions)
+	if err != nil {
+		return err
+	}
+
+	err = recordRoleRevocation(tx, role)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertRolePermissions(tx *sql.Tx, role string, permissions []string) error {
+	for _, permission := range permissions {
+		_, err := tx.Exec(`INSERT INTO role_permissions (role, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING`, role, permission)
+		if isForeignKeyViolation(err) {
+			return ErrUnknownPermission
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (pg *PostgresPermissionStore) DeleteRole(name string) error {
+	if ProtectedRoles[name] {
+		return ErrProtectedRole
+	}
+
+	result, err := pg.db.Exec(`DELETE FROM roles WHERE name = $1`, name)
+	if isForeignKeyViolation(err) {
+		return ErrRoleInUse
+	}
+
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
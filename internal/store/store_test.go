@@ -0,0 +1,116 @@
+package store
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kevin120202/library-management-system/migrations"
+)
+
+// newTestDB connects to the database named by LIBRARY_TEST_DATABASE_URL,
+// migrates it and empties it. Tests that need Postgres are skipped when the
+// variable is unset, so go test ./... stays usable without a database.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("LIBRARY_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("LIBRARY_TEST_DATABASE_URL not set")
+	}
+
+	db, err := Open(dsn)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = MigrateFS(db, migrations.FS, ".")
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	_, err = db.Exec(`TRUNCATE users, books, access_token_revocations, login_throttles RESTART IDENTITY CASCADE`)
+	if err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	return db
+}
+
+// seedLoan lends the only copy of a new general-category book to a new
+// patron and returns both.
+func seedLoan(t *testing.T, db *sql.DB) (*User, *Book, *Loan) {
+	t.Helper()
+
+	user := &User{Username: "patron", Email: "patron@example.com", AccountType: "patron", Address: "1 Main St"}
+	err := user.PasswordHash.Set("correct horse")
+	if err != nil {
+		t.Fatalf("set password: %v", err)
+	}
+
+	err = NewPostgresUserStore(db).CreateUser(user)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	bookStore := NewPostgresBookStore(db)
+	book, err := bookStore.CreateBook(&Book{Title: "Dune", Author: "Frank Herbert", Category: "general"})
+	if err != nil {
+		t.Fatalf("create book: %v", err)
+	}
+
+	err = NewPostgresItemStore(db).CreateItem(&Item{BookID: book.ID, Barcode: "B0001", Condition: "good", Status: "available"})
+	if err != nil {
+		t.Fatalf("create item: %v", err)
+	}
+
+	loan, err := bookStore.BorrowBook(int64(book.ID), int64(user.ID), 14*24*time.Hour)
+	if err != nil {
+		t.Fatalf("borrow: %v", err)
+	}
+
+	return user, book, loan
+}
+
+// seedReadyHold queues a second patron for the book lent by seedLoan and
+// returns the loan, so its copy is set aside for them. It returns the
+// waiting patron and the copy.
+func seedReadyHold(t *testing.T, db *sql.DB) (*User, *Book, *Item) {
+	t.Helper()
+
+	_, book, loan := seedLoan(t, db)
+
+	holder := &User{Username: "holder", Email: "holder@example.com", AccountType: "patron", Address: "2 Main St"}
+	err := holder.PasswordHash.Set("correct horse")
+	if err != nil {
+		t.Fatalf("set password: %v", err)
+	}
+
+	err = NewPostgresUserStore(db).CreateUser(holder)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	_, err = NewPostgresHoldStore(db).CreateHold(int64(book.ID), int64(holder.ID))
+	if err != nil {
+		t.Fatalf("create hold: %v", err)
+	}
+
+	_, err = NewPostgresBorrowReturnStore(db).ReturnBook(int64(loan.ID), 3*24*time.Hour)
+	if err != nil {
+		t.Fatalf("return: %v", err)
+	}
+
+	item, err := NewPostgresItemStore(db).GetItemByID(int64(loan.ItemID))
+	if err != nil {
+		t.Fatalf("get item: %v", err)
+	}
+
+	if item.Status != "on_hold" {
+		t.Fatalf("returned copy status = %q, want on_hold", item.Status)
+	}
+
+	return holder, book, item
+}
@@ -1,7 +1,9 @@
 package store
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/kevin120202/library-management-system/internal/tokens"
@@ -17,10 +19,46 @@ func NewPostgresTokenStore(db *sql.DB) *PostgresTokenStore {
 	}
 }
 
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// ClientInfo identifies the device a login came from, for the session list.
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+// Session is one login: every access and refresh token in a family.
+// LastUsedAt follows stored access tokens; signed access tokens are never
+// stored, so with them it records the last refresh and lags real use by up
+// to one access token lifetime.
+type Session struct {
+	ID         string     `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Current    bool       `json:"current"`
+}
+
 type TokenStore interface {
 	Insert(token *tokens.Token) error
 	CreateNewToken(userID int, ttl time.Duration, scope string) (*tokens.Token, error)
 	DeleteAllTokensForUser(userID int, scope string) error
+	DeleteExpiredTokens() (int64, error)
+	CountActiveTokens(scope string) (int64, error)
+	CreateTokenPair(userID int, accessTTL, refreshTTL time.Duration, client ClientInfo) (access, refresh *tokens.Token, err error)
+	RotateRefreshToken(plaintext string, accessTTL, refreshTTL time.Duration, client ClientInfo) (access, refresh *tokens.Token, err error)
+	TouchToken(plaintext string) error
+	ListSessions(userID int, currentToken, currentSessionID string) ([]Session, error)
+	DeleteSession(userID int, sessionID string) (bool, error)
+	DeleteSessionForToken(plaintext string) error
+	RevokeAllSessions(userID int) error
+	LoadRevocations(maxAge time.Duration) (*tokens.Revocations, error)
+	DeleteStaleRevocations(maxAge time.Duration) (int64, error)
 }
 
 func (t *PostgresTokenStore) CreateNewToken(userID int, ttl time.Duration, scope string) (*tokens.Token, error) {
@@ -34,17 +72,381 @@ func (t *PostgresTokenStore) CreateNewToken(userID int, ttl time.Duration, scope
 }
 
 func (t *PostgresTokenStore) Insert(token *tokens.Token) error {
+	return insertToken(t.db, token)
+}
+
+func insertToken(exec interface {
+	Exec(string, ...any) (sql.Result, error)
+}, token *tokens.Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO tokens (hash, user_id, expiry, scope, family_id, user_agent, ip)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)
 	`
 
-	_, err := t.db.Exec(query, token.Hash, token.UserID, token.Expiry, token.Scope)
+	_, err := exec.Exec(query, token.Hash, token.UserID, token.Expiry, token.Scope, token.FamilyID, token.UserAgent, token.IP)
 	return err
 }
 
+// insertTokenPair issues an access token and a refresh token in the given
+// family. A zero accessTTL issues only the refresh token, for callers that
+// hand out signed access tokens instead of stored ones.
+func insertTokenPair(tx *sql.Tx, userID int, familyID string, accessTTL, refreshTTL time.Duration, client ClientInfo) (*tokens.Token, *tokens.Token, error) {
+	refresh, err := tokens.GenerateToken(userID, refreshTTL, tokens.ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	issued := []*tokens.Token{refresh}
+
+	var access *tokens.Token
+	if accessTTL > 0 {
+		access, err = tokens.GenerateToken(userID, accessTTL, tokens.ScopeAuth)
+		if err != nil {
+			return nil, nil, err
+		}
+		issued = append(issued, access)
+	}
+
+	for _, token := range issued {
+		token.FamilyID = familyID
+		token.UserAgent = client.UserAgent
+		token.IP = client.IP
+		err = insertToken(tx, token)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return access, refresh, nil
+}
+
+// recordRevocation puts a session, or with sessionID empty all of the user's
+// sessions, on the list signed access tokens are checked against. Opaque
+// tokens need no entry: deleting their rows revokes them.
+func recordRevocation(tx *sql.Tx, userID int, sessionID string) error {
+	query := `
+		INSERT INTO access_token_revocations (user_id, session_id, revoked_at)
+		VALUES ($1, NULLIF($2, ''), $3)
+	`
+
+	_, err := tx.Exec(query, userID, sessionID, time.Now())
+	return err
+}
+
+// recordRoleRevocation revokes the signed access tokens of everyone holding
+// role, so a change to its permissions takes effect at their next refresh
+// rather than when their current tokens expire.
+func recordRoleRevocation(tx *sql.Tx, role string) error {
+	query := `
+		INSERT INTO access_token_revocations (user_id, session_id, revoked_at)
+		SELECT id, NULL, $2 FROM users WHERE account_type = $1
+	`
+
+	_, err := tx.Exec(query, role, time.Now())
+	return err
+}
+
+// CreateTokenPair starts a new token family for a fresh login. With a zero
+// accessTTL only the refresh token is stored and access is nil.
+func (t *PostgresTokenStore) CreateTokenPair(userID int, accessTTL, refreshTTL time.Duration, client ClientInfo) (*tokens.Token, *tokens.Token, error) {
+	familyID, err := tokens.NewFamilyID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	access, refresh, err := insertTokenPair(tx, userID, familyID, accessTTL, refreshTTL, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, nil
+}
+
+// RotateRefreshToken spends a refresh token and issues a new pair in the same
+// family, revoking the family's older access tokens. A refresh token that was
+// already spent means it has leaked, so the whole family is revoked and
+// ErrRefreshTokenReused returned.
+func (t *PostgresTokenStore) RotateRefreshToken(plaintext string, accessTTL, refreshTTL time.Duration, client ClientInfo) (*tokens.Token, *tokens.Token, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var familyID sql.NullString
+	var usedAt sql.NullTime
+
+	query := `
+		SELECT user_id, family_id, used_at FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > CURRENT_TIMESTAMP
+		FOR UPDATE
+	`
+
+	err = tx.QueryRow(query, hash[:], tokens.ScopeRefresh).Scan(&userID, &familyID, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if usedAt.Valid {
+		_, err = tx.Exec(`DELETE FROM tokens WHERE family_id = $1`, familyID.String)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = recordRevocation(tx, userID, familyID.String)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return nil, nil, ErrRefreshTokenReused
+	}
+
+	_, err = tx.Exec(`UPDATE tokens SET used_at = CURRENT_TIMESTAMP, last_used_at = CURRENT_TIMESTAMP WHERE hash = $1`, hash[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM tokens WHERE family_id = $1 AND scope = $2`, familyID.String, tokens.ScopeAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access, refresh, err := insertTokenPair(tx, userID, familyID.String, accessTTL, refreshTTL, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, nil
+}
+
 func (t *PostgresTokenStore) DeleteAllTokensForUser(userID int, scope string) error {
 	query := `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`
 	_, err := t.db.Exec(query, scope, userID)
 	return err
 }
+
+func (t *PostgresTokenStore) DeleteExpiredTokens() (int64, error) {
+	result, err := t.db.Exec(`DELETE FROM tokens WHERE expiry < $1`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (t *PostgresTokenStore) CountActiveTokens(scope string) (int64, error) {
+	var count int64
+	err := t.db.QueryRow(`SELECT COUNT(*) FROM tokens WHERE scope = $1 AND expiry > CURRENT_TIMESTAMP`, scope).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// TouchToken records that a token was just used. Writes are limited to one a
+// minute per token so busy clients do not turn every request into an UPDATE.
+func (t *PostgresTokenStore) TouchToken(plaintext string) error {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		UPDATE tokens SET last_used_at = CURRENT_TIMESTAMP
+		WHERE hash = $1
+		AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute')
+	`
+
+	_, err := t.db.Exec(query, hash[:])
+	return err
+}
+
+// ListSessions returns the user's live logins, newest first. A session is
+// live while it still holds an unspent token. The session the request was
+// made in is marked current, found by its stored token or, for a signed
+// access token, by currentSessionID.
+func (t *PostgresTokenStore) ListSessions(userID int, currentToken, currentSessionID string) ([]Session, error) {
+	hash := sha256.Sum256([]byte(currentToken))
+
+	query := `
+		SELECT
+			family_id,
+			MIN(created_at),
+			MAX(last_used_at),
+			MAX(expiry),
+			(array_agg(user_agent ORDER BY created_at DESC))[1],
+			(array_agg(ip ORDER BY created_at DESC))[1],
+			bool_or(hash = $2) OR family_id = $5
+		FROM tokens
+		WHERE user_id = $1
+		AND scope IN ($3, $4)
+		AND family_id IS NOT NULL
+		AND expiry > CURRENT_TIMESTAMP
+		GROUP BY family_id
+		HAVING bool_or(used_at IS NULL)
+		ORDER BY MIN(created_at) DESC
+	`
+
+	rows, err := t.db.Query(query, userID, hash[:], tokens.ScopeAuth, tokens.ScopeRefresh, currentSessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err = rows.Scan(&session.ID, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt, &session.UserAgent, &session.IP, &session.Current)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteSession revokes one of the user's sessions. It reports false when the
+// user has no such session.
+func (t *PostgresTokenStore) DeleteSession(userID int, sessionID string) (bool, error) {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM tokens WHERE user_id = $1 AND family_id = $2`, userID, sessionID)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if deleted == 0 {
+		return false, nil
+	}
+
+	err = recordRevocation(tx, userID, sessionID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// DeleteSessionForToken revokes the session the token belongs to.
+func (t *PostgresTokenStore) DeleteSessionForToken(plaintext string) error {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE family_id = (SELECT family_id FROM tokens WHERE hash = $1)
+		OR hash = $1
+	`
+
+	_, err := t.db.Exec(query, hash[:])
+	return err
+}
+
+// RevokeAllSessions logs the user out everywhere.
+func (t *PostgresTokenStore) RevokeAllSessions(userID int) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM tokens WHERE user_id = $1 AND scope IN ($2, $3)`, userID, tokens.ScopeAuth, tokens.ScopeRefresh)
+	if err != nil {
+		return err
+	}
+
+	err = recordRevocation(tx, userID, "")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LoadRevocations returns the revocations younger than maxAge, the access
+// token lifetime; older ones only cover tokens that have expired anyway.
+func (t *PostgresTokenStore) LoadRevocations(maxAge time.Duration) (*tokens.Revocations, error) {
+	query := `
+		SELECT user_id, COALESCE(session_id, ''), revoked_at
+		FROM access_token_revocations
+		WHERE revoked_at > $1
+	`
+
+	rows, err := t.db.Query(query, time.Now().Add(-maxAge))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revocations := &tokens.Revocations{Sessions: map[string]bool{}, Users: map[int]time.Time{}}
+	for rows.Next() {
+		var userID int
+		var sessionID string
+		var revokedAt time.Time
+
+		err = rows.Scan(&userID, &sessionID, &revokedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if sessionID != "" {
+			revocations.Sessions[sessionID] = true
+		} else if revokedAt.After(revocations.Users[userID]) {
+			revocations.Users[userID] = revokedAt
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revocations, nil
+}
+
+func (t *PostgresTokenStore) DeleteStaleRevocations(maxAge time.Duration) (int64, error) {
+	result, err := t.db.Exec(`DELETE FROM access_token_revocations WHERE revoked_at <= $1`, time.Now().Add(-maxAge))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrivilegeChangesRevokeSignedTokens(t *testing.T) {
+	db := newTestDB(t)
+	userStore := NewPostgresUserStore(db)
+	tokenStore := NewPostgresTokenStore(db)
+	user, _, _ := seedLoan(t, db)
+
+	revokedSince := func(t *testing.T, since time.Time) bool {
+		t.Helper()
+		revocations, err := tokenStore.LoadRevocations(time.Hour)
+		if err != nil {
+			t.Fatalf("load revocations: %v", err)
+		}
+		return !revocations.Users[user.ID].Before(since)
+	}
+
+	err := NewPostgresPermissionStore(db).CreateRole(&Role{Name: "clerk", Permissions: []string{}})
+	if err != nil {
+		t.Fatalf("create role: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func() error
+	}{
+		{"role change", func() error {
+			_, err := userStore.UpdateUserRole(int64(user.ID), "clerk")
+			return err
+		}},
+		{"role permissions change", func() error {
+			return NewPostgresPermissionStore(db).SetRolePermissions("clerk", []string{})
+		}},
+		{"two-factor reset", func() error {
+			return NewPostgresTwoFactorStore(db).DisableTwoFactor(int64(user.ID))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := time.Now().Add(-time.Millisecond)
+			err := tt.change()
+			if err != nil {
+				t.Fatalf("change: %v", err)
+			}
+			if !revokedSince(t, before) {
+				t.Fatalf("no revocation recorded for user %d", user.ID)
+			}
+		})
+	}
+}
+
+func TestSignedSessionIsCurrentAndTouchedOnRefresh(t *testing.T) {
+	db := newTestDB(t)
+	tokenStore := NewPostgresTokenStore(db)
+	user, _, _ := seedLoan(t, db)
+
+	// A zero access TTL stores only the refresh token, as in signed mode.
+	_, refresh, err := tokenStore.CreateTokenPair(user.ID, 0, time.Hour, ClientInfo{UserAgent: "test"})
+	if err != nil {
+		t.Fatalf("create pair: %v", err)
+	}
+
+	_, _, err = tokenStore.RotateRefreshToken(refresh.Plaintext, 0, time.Hour, ClientInfo{UserAgent: "test"})
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+
+	sessions, err := tokenStore.ListSessions(user.ID, "", refresh.FamilyID)
+	if err != nil {
+		t.Fatalf("list sessions: %v", err)
+	}
+
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+
+	if !sessions[0].Current {
+		t.Error("session not marked current by session ID")
+	}
+
+	if sessions[0].LastUsedAt == nil {
+		t.Error("last_used_at not set by refresh")
+	}
+}
@@ -0,0 +1,223 @@
+package store
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// TOTPSecret is a user's authenticator secret. EnabledAt is nil while the
+// user has started enrolment but not yet confirmed a code.
+type TOTPSecret struct {
+	UserID       int
+	Secret       string
+	EnabledAt    *time.Time
+	LastUsedStep *int64
+}
+
+// NormalizeRecoveryCode lets users type recovery codes with or without the
+// dash and in either case.
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func hashRecoveryCode(code string) []byte {
+	hash := sha256.Sum256([]byte(NormalizeRecoveryCode(code)))
+	return hash[:]
+}
+
+type PostgresTwoFactorStore struct {
+	db *sql.DB
+}
+
+func NewPostgresTwoFactorStore(db *sql.DB) *PostgresTwoFactorStore {
+	return &PostgresTwoFactorStore{
+		db: db,
+	}
+}
+
+type TwoFactorStore interface {
+	BeginEnrollment(userID int, secret string, recoveryCodes []string) error
+	GetTOTPSecret(userID int) (*TOTPSecret, error)
+	EnableTwoFactor(userID int) error
+	DisableTwoFactor(userID int64) error
+	RecordTOTPStep(userID int, step int64) (bool, error)
+	UseRecoveryCode(userID int, code string) (bool, error)
+}
+
+// BeginEnrollment stores a new, not yet enabled secret and recovery codes
+// for the user, replacing any earlier unfinished enrolment.
+func (pg *PostgresTwoFactorStore) BeginEnrollment(userID int, secret string, recoveryCodes []string) error {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO user_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, enabled_at = NULL, last_used_step = NULL, created_at = CURRENT_TIMESTAMP
+	`
+
+	_, err = tx.Exec(query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err = tx.Exec(`INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (pg *PostgresTwoFactorStore) GetTOTPSecret(userID int) (*TOTPSecret, error) {
+	secret := &TOTPSecret{}
+	var enabledAt sql.NullTime
+	var lastUsedStep sql.NullInt64
+
+	query := `
+		SELECT user_id, secret, enabled_at, last_used_step
+		FROM user_totp
+		WHERE user_id = $1
+	`
+
+	err := pg.db.QueryRow(query, userID).Scan(&secret.UserID, &secret.Secret, &enabledAt, &lastUsedStep)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if enabledAt.Valid {
+		secret.EnabledAt = &enabledAt.Time
+	}
+	if lastUsedStep.Valid {
+		secret.LastUsedStep = &lastUsedStep.Int64
+	}
+
+	return secret, nil
+}
+
+func (pg *PostgresTwoFactorStore) EnableTwoFactor(userID int) error {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE user_totp SET enabled_at = CURRENT_TIMESTAMP WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE users SET two_factor_enabled = TRUE, updated_at = CURRENT_TIMESTAMP WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	err = recordRevocation(tx, userID, "")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableTwoFactor removes the user's secret and recovery codes. It returns
+// sql.ErrNoRows when there is no such user. Like EnableTwoFactor it revokes
+// the user's signed access tokens, whose claims carry the old setting.
+func (pg *PostgresTwoFactorStore) DisableTwoFactor(userID int64) error {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE users SET two_factor_enabled = FALSE, updated_at = CURRENT_TIMESTAMP WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec(`DELETE FROM user_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	err = recordRevocation(tx, int(userID), "")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RecordTOTPStep marks step as used and reports false if it, or a later one,
+// was already used, so each code works only once.
+func (pg *PostgresTwoFactorStore) RecordTOTPStep(userID int, step int64) (bool, error) {
+	query := `
+		UPDATE user_totp SET last_used_step = $2
+		WHERE user_id = $1 AND (last_used_step IS NULL OR last_used_step < $2)
+	`
+
+	result, err := pg.db.Exec(query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// UseRecoveryCode spends one of the user's recovery codes and reports
+// whether it was valid and unused.
+func (pg *PostgresTwoFactorStore) UseRecoveryCode(userID int, code string) (bool, error) {
+	query := `
+		UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND hash = $2 AND used_at IS NULL
+	`
+
+	result, err := pg.db.Exec(query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
@@ -0,0 +1,65 @@
+package store
+
+import "testing"
+
+func TestRecordTOTPStepRejectsReplay(t *testing.T) {
+	db := newTestDB(t)
+	twoFactorStore := NewPostgresTwoFactorStore(db)
+	user, _, _ := seedLoan(t, db)
+
+	err := twoFactorStore.BeginEnrollment(user.ID, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", nil)
+	if err != nil {
+		t.Fatalf("begin enrollment: %v", err)
+	}
+
+	steps := []struct {
+		step int64
+		want bool
+	}{
+		{100, true},
+		{100, false}, // the same code again
+		{99, false},  // an older code still inside the skew window
+		{101, true},
+	}
+
+	for _, s := range steps {
+		ok, err := twoFactorStore.RecordTOTPStep(user.ID, s.step)
+		if err != nil {
+			t.Fatalf("record step %d: %v", s.step, err)
+		}
+		if ok != s.want {
+			t.Errorf("RecordTOTPStep(%d) = %v, want %v", s.step, ok, s.want)
+		}
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	db := newTestDB(t)
+	twoFactorStore := NewPostgresTwoFactorStore(db)
+	user, _, _ := seedLoan(t, db)
+
+	err := twoFactorStore.BeginEnrollment(user.ID, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", []string{"abcde-fghij", "klmno-pqrst"})
+	if err != nil {
+		t.Fatalf("begin enrollment: %v", err)
+	}
+
+	attempts := []struct {
+		code string
+		want bool
+	}{
+		{"ABCDE FGHIJ", true},  // normalised before hashing
+		{"abcde-fghij", false}, // already spent
+		{"zzzzz-zzzzz", false},
+		{"klmnopqrst", true},
+	}
+
+	for _, a := range attempts {
+		ok, err := twoFactorStore.UseRecoveryCode(user.ID, a.code)
+		if err != nil {
+			t.Fatalf("use %q: %v", a.code, err)
+		}
+		if ok != a.want {
+			t.Errorf("UseRecoveryCode(%q) = %v, want %v", a.code, ok, a.want)
+		}
+	}
+}
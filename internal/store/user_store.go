@@ -1,15 +1,26 @@
 package store
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/kevin120202/library-management-system/internal/tokens"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrDuplicateUser = errors.New("username or email already taken")
+	ErrUnknownRole   = errors.New("unknown role")
+	ErrActiveLoans   = errors.New("user has items on loan")
+	ErrUnpaidBalance = errors.New("user has an outstanding balance")
+)
+
 type password struct {
 	plaintext string
 	hash      []byte
@@ -39,15 +50,32 @@ func (p *password) Matches(plainTextPassword string) (bool, error) {
 	return true, nil
 }
 
+var (
+	dummyPasswordOnce sync.Once
+	dummyPassword     password
+)
+
+// CompareDummyPassword spends as long as checking a real password would, so
+// logins for unknown usernames take the same time as wrong passwords.
+func CompareDummyPassword(plaintext string) {
+	dummyPasswordOnce.Do(func() {
+		_ = dummyPassword.Set("not-a-real-password")
+	})
+	_, _ = dummyPassword.Matches(plaintext)
+}
+
 type User struct {
-	ID           int       `json:"id"`
-	Username     string    `json:"username"`
-	Email        string    `json:"email"`
-	PasswordHash password  `json:"-"`
-	AccountType  string    `json:"account_type"`
-	Address      string    `json:"address"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID               int       `json:"id"`
+	Username         string    `json:"username"`
+	Email            string    `json:"email"`
+	PasswordHash     password  `json:"-"`
+	AccountType      string    `json:"account_type"`
+	Address          string    `json:"address"`
+	Activated        bool      `json:"activated"`
+	TwoFactorEnabled bool      `json:"two_factor_enabled"`
+	Permissions      []string  `json:"permissions,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
 }
 
 var AnonymousUser = &User{}
@@ -56,6 +84,19 @@ func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+func (u *User) IsAdmin() bool {
+	return u.AccountType == "admin"
+}
+
+func (u *User) HasPermission(permission string) bool {
+	for _, p := range u.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
 type PostgresUserStore struct {
 	db *sql.DB
 }
@@ -68,18 +109,44 @@ func NewPostgresUserStore(db *sql.DB) *PostgresUserStore {
 
 type UserStore interface {
 	CreateUser(*User) error
+	GetUserByID(id int) (*User, error)
 	GetUserByUsername(username string) (*User, error)
-	GetUserToken(plainTextPassword string) (*User, error)
+	GetUserByEmail(email string) (*User, error)
+	GetUserToken(scope, plainTextPassword string) (*User, error)
+	UpdatePassword(user *User) error
+	UpdateProfile(user *User) error
+	AnonymizeUser(userID int, pickupWindow time.Duration) error
+	ActivateUser(user *User) error
+	UpdateUserRole(userID int64, role string) (*User, error)
+	ListUsers(params UserListParams) (*Page[User], error)
+}
+
+type UserListParams struct {
+	ListParams
+	AccountType string
+}
+
+var userSortKeys = map[string]sortKey{
+	"username":   {column: "username", cast: "TEXT"},
+	"created_at": {column: "created_at", cast: "TIMESTAMPTZ"},
 }
 
 func (s *PostgresUserStore) CreateUser(user *User) error {
 	query := `
-		INSERT INTO users (username, email, password_hash, account_type, address)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO users (username, email, password_hash, account_type, address, activated)
+		VALUES ($1, $2, $3, $4, $5, $6)
 		RETURNING id, created_at, updated_at
 	`
 
-	err := s.db.QueryRow(query, user.Username, user.Email, user.PasswordHash.hash, user.AccountType, user.Address).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	err := s.db.QueryRow(query, user.Username, user.Email, user.PasswordHash.hash, user.AccountType, user.Address, user.Activated).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	if isUniqueViolation(err) {
+		return ErrDuplicateUser
+	}
+
+	if isForeignKeyViolation(err) {
+		return ErrUnknownRole
+	}
+
 	if err != nil {
 		return err
 	}
@@ -93,11 +160,33 @@ func (s *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
 	}
 
 	query := `
-		SELECT id, username, email, password_hash, account_type, address, created_at, updated_at
+		SELECT id, username, email, password_hash, account_type, address, activated, two_factor_enabled, created_at, updated_at
 		FROM users WHERE username = $1
 	`
 
-	err := s.db.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash.hash, &user.AccountType, &user.Address, &user.CreatedAt, &user.UpdatedAt)
+	err := s.db.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash.hash, &user.AccountType, &user.Address, &user.Activated, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *PostgresUserStore) GetUserByID(id int) (*User, error) {
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	query := `
+		SELECT id, username, email, password_hash, account_type, address, activated, two_factor_enabled, created_at, updated_at
+		FROM users WHERE id = $1
+	`
+
+	err := s.db.QueryRow(query, id).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash.hash, &user.AccountType, &user.Address, &user.Activated, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -109,38 +198,362 @@ func (s *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
 	return user, nil
 }
 
-func (s *PostgresUserStore) GetUserToken(plainTextPassword string) (*User, error) {
+func (s *PostgresUserStore) GetUserByEmail(email string) (*User, error) {
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	query := `
+		SELECT id, username, email, password_hash, account_type, address, activated, two_factor_enabled, created_at, updated_at
+		FROM users WHERE lower(email) = lower($1)
+	`
+
+	err := s.db.QueryRow(query, email).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash.hash, &user.AccountType, &user.Address, &user.Activated, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// GetUserToken returns the owner of an unexpired token of the given scope,
+// so a password reset token can never be replayed as a bearer token.
+func (s *PostgresUserStore) GetUserToken(scope, plainTextPassword string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(plainTextPassword))
 	query := `
-		SELECT users.id, users.username, users.email, users.password_hash, users.account_type, users.address, users.created_at, users.updated_at FROM users
+		SELECT users.id, users.username, users.email, users.password_hash, users.account_type, users.address, users.activated, users.two_factor_enabled, users.created_at, users.updated_at FROM users
 		INNER JOIN tokens ON tokens.user_id = users.id
-		WHERE tokens.hash = $1 AND tokens.expiry > $2
+		WHERE tokens.hash = $1 AND tokens.scope = $2 AND tokens.expiry > $3
 	`
 
 	user := &User{
 		PasswordHash: password{},
 	}
 
-	err := s.db.QueryRow(query, tokenHash[:], time.Now()).Scan(
+	err := s.db.QueryRow(query, tokenHash[:], scope, time.Now()).Scan(
 		&user.ID,
 		&user.Username,
 		&user.Email,
 		&user.PasswordHash.hash,
 		&user.AccountType,
 		&user.Address,
+		&user.Activated,
+		&user.TwoFactorEnabled,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
 
 	if err == sql.ErrNoRows {
-		fmt.Print("sql.ErrNoRows")
 		return nil, nil
 	}
 
 	if err != nil {
-		fmt.Printf("ERROR: GetUserToken %v", err)
 		return nil, err
 	}
 
 	return user, nil
 }
+
+// UpdatePassword stores the user's new password hash and revokes every
+// token they hold, signing out all sessions and spending any outstanding
+// reset token.
+func (s *PostgresUserStore) UpdatePassword(user *User) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users SET password_hash = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+		RETURNING updated_at
+	`
+
+	err = tx.QueryRow(query, user.PasswordHash.hash, user.ID).Scan(&user.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM tokens WHERE user_id = $1`, user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = recordRevocation(tx, user.ID, "")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateProfile stores the user's email, address and activation state. A
+// changed email is expected to arrive with Activated cleared so the new
+// address is verified before the account can borrow again.
+func (s *PostgresUserStore) UpdateProfile(user *User) error {
+	query := `
+		UPDATE users SET email = $1, address = $2, activated = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $4
+		RETURNING updated_at
+	`
+
+	err := s.db.QueryRow(query, user.Email, user.Address, user.Activated, user.ID).Scan(&user.UpdatedAt)
+	if isUniqueViolation(err) {
+		return ErrDuplicateUser
+	}
+
+	return err
+}
+
+// AnonymizeUser closes a patron's account without deleting the row, since
+// loans, fines and payments reference it. Personal data is overwritten, the
+// password is replaced with one nobody knows, credentials are revoked and
+// any holds are cancelled, passing ready items on to the next in line. It
+// refuses while the user still has items on loan or owes money.
+func (s *PostgresUserStore) AnonymizeUser(userID int, pickupWindow time.Duration) error {
+	var unusable password
+	err := unusable.Set(rand.Text())
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var username string
+	err = tx.QueryRow(`SELECT username FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, userID).Scan(&username)
+	if err != nil {
+		return err
+	}
+
+	var onLoan bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM borrows_returns WHERE user_id = $1 AND returned_at IS NULL)`, userID).Scan(&onLoan)
+	if err != nil {
+		return err
+	}
+
+	if onLoan {
+		return ErrActiveLoans
+	}
+
+	balance, err := outstandingBalance(tx, int64(userID))
+	if err != nil {
+		return err
+	}
+
+	if balance > 0 {
+		return ErrUnpaidBalance
+	}
+
+	holdQuery := `
+		UPDATE holds SET status = 'cancelled'
+		WHERE user_id = $1 AND status IN ('waiting', 'ready')
+		RETURNING item_id, book_id
+	`
+
+	released, _, err := collectHeldItems(tx, holdQuery, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range released {
+		err = releaseItem(tx, item.itemID, item.bookID, pickupWindow)
+		if err != nil {
+			return err
+		}
+	}
+
+	placeholder := fmt.Sprintf("deleted-%d-%s", userID, strings.ToLower(rand.Text()[:8]))
+	userQuery := `
+		UPDATE users
+		SET username = $1, email = $2, address = '', password_hash = $3, account_type = 'patron',
+			activated = FALSE, two_factor_enabled = FALSE, deleted_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $4
+	`
+
+	_, err = tx.Exec(userQuery, placeholder, placeholder+"@deleted.invalid", unusable.hash, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		`DELETE FROM tokens WHERE user_id = $1`,
+		`DELETE FROM api_keys WHERE user_id = $1`,
+		`DELETE FROM user_identities WHERE user_id = $1`,
+		`DELETE FROM user_totp WHERE user_id = $1`,
+		`DELETE FROM recovery_codes WHERE user_id = $1`,
+	} {
+		_, err = tx.Exec(query, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM login_throttles WHERE key = $1 OR key = $2`, UserThrottleKey(username), TwoFactorThrottleKey(userID))
+	if err != nil {
+		return err
+	}
+
+	err = recordRevocation(tx, userID, "")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ActivateUser marks the user's email as verified and spends their
+// activation tokens.
+func (s *PostgresUserStore) ActivateUser(user *User) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users SET activated = TRUE, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING activated, updated_at
+	`
+
+	err = tx.QueryRow(query, user.ID).Scan(&user.Activated, &user.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM tokens WHERE user_id = $1 AND scope = $2`, user.ID, tokens.ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateUserRole changes the user's role and revokes their signed access
+// tokens, which would otherwise keep the old role's permissions until they
+// expire.
+func (s *PostgresUserStore) UpdateUserRole(userID int64, role string) (*User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	user := &User{}
+
+	query := `
+		UPDATE users
+		SET account_type = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+		RETURNING id, username, email, account_type, address, activated, two_factor_enabled, created_at, updated_at
+	`
+
+	err = tx.QueryRow(query, role, userID).Scan(&user.ID, &user.Username, &user.Email, &user.AccountType, &user.Address, &user.Activated, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if isForeignKeyViolation(err) {
+		return nil, ErrUnknownRole
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = recordRevocation(tx, user.ID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *PostgresUserStore) ListUsers(params UserListParams) (*Page[User], error) {
+	key, ok := userSortKeys[params.Sort]
+	if !ok {
+		return nil, ErrInvalidSort
+	}
+
+	var conditions []string
+	var args []any
+
+	if params.AccountType != "" {
+		args = append(args, params.AccountType)
+		conditions = append(conditions, fmt.Sprintf("account_type = $%d", len(args)))
+	}
+
+	filtered := len(conditions) > 0
+	countQuery := `SELECT COUNT(*) FROM users ` + whereClause(conditions)
+	countArgs := args
+
+	keyset, args := keysetCondition(params.ListParams, key, "id", args)
+	if keyset != "" {
+		conditions = append(conditions, keyset)
+	}
+
+	args = append(args, params.Limit+1)
+	query := `
+		SELECT id, username, email, account_type, address, activated, two_factor_enabled, created_at, updated_at
+		FROM users
+		` + whereClause(conditions) + `
+		` + orderBy(params.ListParams, key, "id") + fmt.Sprintf(" LIMIT $%d", len(args))
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &Page[User]{Items: []User{}}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.AccountType, &user.Address, &user.Activated, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Items) > params.Limit {
+		page.Items = page.Items[:params.Limit]
+		last := page.Items[len(page.Items)-1]
+		page.NextCursor = &Cursor{Sort: params.Sort, ID: int64(last.ID)}
+		switch params.Sort {
+		case "username":
+			page.NextCursor.Value = last.Username
+		case "created_at":
+			page.NextCursor.Value = last.CreatedAt.UTC().Format(time.RFC3339Nano)
+		}
+	}
+
+	if filtered {
+		err = s.db.QueryRow(countQuery, countArgs...).Scan(&page.TotalEstimate)
+	} else {
+		page.TotalEstimate, err = estimateRows(s.db, "users")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
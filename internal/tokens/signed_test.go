@@ -0,0 +1,171 @@
+package tokens
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T, seed byte) ed25519.PrivateKey {
+	t.Helper()
+	return ed25519.NewKeyFromSeed([]byte(strings.Repeat(string(rune('a'+seed)), ed25519.SeedSize)))
+}
+
+func testSigner(t *testing.T, active string, keys map[string]ed25519.PrivateKey) *Signer {
+	t.Helper()
+	signer, err := NewSigner(active, keys)
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	return signer
+}
+
+var testClaims = AccessClaims{
+	UserID:      7,
+	Username:    "reader",
+	Role:        "patron",
+	Permissions: []string{"catalog:read"},
+	Activated:   true,
+	SessionID:   "session-1",
+}
+
+// forge builds a token with the given header and the payload of a genuine
+// token, signed however sign decides.
+func forge(t *testing.T, genuine string, header map[string]string, sign func(signingInput string) []byte) string {
+	t.Helper()
+
+	rawHeader, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("marshal header: %v", err)
+	}
+
+	payload := strings.Split(genuine, ".")[1]
+	signingInput := b64.EncodeToString(rawHeader) + "." + payload
+	return signingInput + "." + b64.EncodeToString(sign(signingInput))
+}
+
+func TestVerify(t *testing.T) {
+	oldKey, newKey, strangerKey := testKey(t, 0), testKey(t, 1), testKey(t, 2)
+
+	// The verifier has rotated to "new" but keeps "old" for its grace
+	// period.
+	verifier := testSigner(t, "new", map[string]ed25519.PrivateKey{"old": oldKey, "new": newKey})
+	retiring := testSigner(t, "old", map[string]ed25519.PrivateKey{"old": oldKey})
+	stranger := testSigner(t, "new", map[string]ed25519.PrivateKey{"new": strangerKey})
+
+	sign := func(signer *Signer, ttl time.Duration) string {
+		t.Helper()
+		token, err := signer.Sign(testClaims, ttl)
+		if err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		return token.Plaintext
+	}
+
+	genuine := sign(verifier, time.Minute)
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"active key", genuine, true},
+		{"retired key in grace period", sign(retiring, time.Minute), true},
+		{"unknown kid", forge(t, genuine, map[string]string{"alg": "EdDSA", "typ": "JWT", "kid": "gone"}, func(in string) []byte {
+			return ed25519.Sign(newKey, []byte(in))
+		}), false},
+		{"known kid, other key", sign(stranger, time.Minute), false},
+		{"alg none", forge(t, genuine, map[string]string{"alg": "none", "typ": "JWT", "kid": "new"}, func(string) []byte {
+			return nil
+		}), false},
+		{"alg HS256 keyed with the public key", forge(t, genuine, map[string]string{"alg": "HS256", "typ": "JWT", "kid": "new"}, func(in string) []byte {
+			mac := hmac.New(sha256.New, newKey.Public().(ed25519.PublicKey))
+			mac.Write([]byte(in))
+			return mac.Sum(nil)
+		}), false},
+		{"expired", sign(verifier, -time.Second), false},
+		{"tampered payload", strings.Replace(genuine, ".", ".e30", 1), false},
+		{"not a JWT", "abc.def", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifier.Verify(tt.token)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				if claims.UserID != testClaims.UserID || claims.SessionID != testClaims.SessionID || claims.Role != testClaims.Role {
+					t.Fatalf("claims = %+v", claims)
+				}
+				return
+			}
+			if err != ErrInvalidSignedToken {
+				t.Fatalf("Verify err = %v, want ErrInvalidSignedToken", err)
+			}
+		})
+	}
+
+	t.Run("retired key after removal", func(t *testing.T) {
+		token := sign(retiring, time.Minute)
+		rotated := testSigner(t, "new", map[string]ed25519.PrivateKey{"new": newKey})
+		if _, err := rotated.Verify(token); err != ErrInvalidSignedToken {
+			t.Fatalf("Verify err = %v, want ErrInvalidSignedToken", err)
+		}
+	})
+}
+
+func TestVerifyKeepsMillisecondIssuedAt(t *testing.T) {
+	signer := testSigner(t, "k", map[string]ed25519.PrivateKey{"k": testKey(t, 0)})
+
+	before := time.Now().Truncate(time.Millisecond)
+	token, err := signer.Sign(testClaims, time.Minute)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	claims, err := signer.Verify(token.Plaintext)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if claims.IssuedAt.Before(before) || claims.IssuedAt.Nanosecond()%int(time.Millisecond) != 0 {
+		t.Fatalf("IssuedAt = %v, want a whole millisecond at or after %v", claims.IssuedAt, before)
+	}
+}
+
+func TestRevoked(t *testing.T) {
+	issued := time.UnixMilli(1_700_000_000_123)
+
+	tests := []struct {
+		name        string
+		revocations Revocations
+		revoked     bool
+	}{
+		{"nothing revoked", Revocations{}, false},
+		{"session revoked", Revocations{Sessions: map[string]bool{"session-1": true}}, true},
+		{"other session revoked", Revocations{Sessions: map[string]bool{"session-2": true}}, false},
+		{"user revoked a millisecond later", Revocations{Users: map[int]time.Time{7: issued.Add(time.Millisecond)}}, true},
+		{"user revoked later in the same millisecond", Revocations{Users: map[int]time.Time{7: issued.Add(400 * time.Microsecond)}}, true},
+		{"user revoked at the start of the issuing millisecond", Revocations{Users: map[int]time.Time{7: issued}}, false},
+		{"user revoked a millisecond earlier", Revocations{Users: map[int]time.Time{7: issued.Add(-time.Millisecond)}}, false},
+		{"other user revoked", Revocations{Users: map[int]time.Time{8: issued.Add(time.Hour)}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := NewRevocationList()
+			list.Replace(&tt.revocations)
+
+			claims := testClaims
+			claims.IssuedAt = issued
+			if got := list.Revoked(&claims); got != tt.revoked {
+				t.Fatalf("Revoked = %v, want %v", got, tt.revoked)
+			}
+		})
+	}
+}
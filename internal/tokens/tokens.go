@@ -4,20 +4,45 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"encoding/hex"
 	"time"
 )
 
 const (
-	ScopeAuth  = "authentication"
-	ScopeAdmin = "admin"
+	ScopeAuth          = "authentication"
+	ScopeAdmin         = "admin"
+	ScopePasswordReset = "password-reset"
+	ScopeActivation    = "activation"
+	ScopeRefresh       = "refresh"
+	ScopeAPIKey        = "api-key"
+	ScopeTwoFactor     = "two-factor"
 )
 
+// APIKeyPrefix marks API keys so Authenticate can tell them from session
+// tokens at a glance, and so leaked keys are easy to spot in logs and
+// secret scanners.
+const APIKeyPrefix = "lib_"
+
 type Token struct {
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int       `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	FamilyID  string    `json:"-"`
+	UserAgent string    `json:"-"`
+	IP        string    `json:"-"`
+}
+
+// NewFamilyID names a login's chain of access and refresh tokens, so the
+// whole chain can be revoked at once.
+func NewFamilyID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error) {
@@ -38,3 +63,21 @@ func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error)
 	token.Hash = hash[:]
 	return token, nil
 }
+
+// GenerateAPIKey returns a prefixed token for use as a long-lived API key.
+// A zero ttl means the key does not expire.
+func GenerateAPIKey(userID int, ttl time.Duration) (*Token, error) {
+	token, err := GenerateToken(userID, ttl, ScopeAPIKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl == 0 {
+		token.Expiry = time.Time{}
+	}
+
+	token.Plaintext = APIKeyPrefix + token.Plaintext
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+	return token, nil
+}
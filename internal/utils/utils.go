@@ -2,7 +2,8 @@ package utils
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 
@@ -25,16 +26,30 @@ func WriteJSON(w http.ResponseWriter, status int, data Envelope) error {
 }
 
 func ReadIDParam(r *http.Request) (int64, error) {
-	idParam := chi.URLParam(r, "id")
+	return ReadNamedIDParam(r, "id")
+}
+
+func ReadNamedIDParam(r *http.Request, name string) (int64, error) {
+	idParam := chi.URLParam(r, name)
 
 	if idParam == "" {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 
 	id, err := strconv.ParseInt(idParam, 10, 64)
 	if err != nil {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 
 	return id, nil
 }
+
+// ClientIP returns the address of the connection's peer without the port.
+// It deliberately ignores X-Forwarded-For, which any client can forge.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
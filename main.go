@@ -1,40 +1,102 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/kevin120202/library-management-system/internal/app"
+	"github.com/kevin120202/library-management-system/internal/config"
 	"github.com/kevin120202/library-management-system/internal/routes"
 )
 
 func main() {
-	var port int
-	flag.IntVar(&port, "port", 8080, "go backend server port")
-	flag.Parse()
+	var bootstrapAdmin bool
+	flag.BoolVar(&bootstrapAdmin, "bootstrap-admin", false, "create an admin from LIBRARY_ADMIN_USERNAME, LIBRARY_ADMIN_EMAIL, LIBRARY_ADMIN_PASSWORD and LIBRARY_ADMIN_ADDRESS")
 
-	app, err := app.NewApplication()
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	app, err := app.NewApplication(cfg)
 	if err != nil {
 		panic(err)
 	}
-	defer app.DB.Close()
+
+	if bootstrapAdmin {
+		err = app.BootstrapAdmin(
+			os.Getenv("LIBRARY_ADMIN_USERNAME"),
+			os.Getenv("LIBRARY_ADMIN_EMAIL"),
+			os.Getenv("LIBRARY_ADMIN_PASSWORD"),
+			os.Getenv("LIBRARY_ADMIN_ADDRESS"),
+		)
+		if err != nil {
+			app.Logger.Error("bootstrap admin failed", "error", err)
+			os.Exit(1)
+		}
+	}
 
 	r := routes.SetupRoutes(app)
 
 	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
+		Addr:         fmt.Sprintf(":%d", cfg.Port),
 		Handler:      r,
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
 
-	app.Logger.Printf("we are running on port %d\n", port)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		app.Logger.Info("server listening", "port", cfg.Port)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	exitCode := 0
 
-	err = server.ListenAndServe()
+	select {
+	case err = <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			app.Logger.Error("server failed", "error", err)
+			exitCode = 1
+		}
+	case <-ctx.Done():
+		// Restore default signal handling so a second Ctrl-C kills the
+		// process straight away.
+		stop()
+
+		app.Logger.Info("shutting down", "drain_delay", cfg.DrainDelay.String())
+		app.StartDraining()
+		time.Sleep(cfg.DrainDelay)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+
+		err = server.Shutdown(shutdownCtx)
+		if err != nil {
+			app.Logger.Error("shutdown did not complete", "error", err)
+			exitCode = 1
+		} else {
+			app.Logger.Info("in-flight requests finished")
+		}
+	}
+
+	err = app.Close()
 	if err != nil {
-		app.Logger.Fatal(err)
+		app.Logger.Error("cleanup failed", "error", err)
+		exitCode = 1
 	}
+
+	os.Exit(exitCode)
 }
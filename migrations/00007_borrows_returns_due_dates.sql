@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+UPDATE books SET availability = TRUE WHERE availability IS NULL;
+ALTER TABLE books
+    ALTER COLUMN availability SET DEFAULT TRUE,
+    ALTER COLUMN availability SET NOT NULL;
+
+ALTER TABLE borrows_returns
+    ADD COLUMN borrowed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD COLUMN due_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP + INTERVAL '14 days',
+    ADD COLUMN returned_at TIMESTAMP WITH TIME ZONE;
+
+CREATE UNIQUE INDEX IF NOT EXISTS borrows_returns_open_loan_idx
+    ON borrows_returns (book_id) WHERE returned_at IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS borrows_returns_open_loan_idx;
+ALTER TABLE borrows_returns
+    DROP COLUMN returned_at,
+    DROP COLUMN due_at,
+    DROP COLUMN borrowed_at;
+ALTER TABLE books
+    ALTER COLUMN availability DROP NOT NULL,
+    ALTER COLUMN availability DROP DEFAULT;
+-- +goose StatementEnd
@@ -0,0 +1,58 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS items (
+    id BIGSERIAL PRIMARY KEY,
+    book_id BIGINT NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    barcode VARCHAR(64) UNIQUE NOT NULL,
+    shelf_location VARCHAR(100) NOT NULL DEFAULT '',
+    condition VARCHAR(20) NOT NULL DEFAULT 'good'
+        CHECK (condition IN ('new', 'good', 'fair', 'poor', 'damaged')),
+    status VARCHAR(20) NOT NULL DEFAULT 'available'
+        CHECK (status IN ('available', 'on_loan', 'maintenance', 'lost', 'withdrawn')),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS items_book_status_idx ON items (book_id, status);
+
+-- every existing book becomes a single copy so open loans keep pointing at something
+INSERT INTO items (book_id, barcode, status)
+SELECT id, 'LEGACY-' || id, CASE WHEN availability THEN 'available' ELSE 'on_loan' END
+FROM books;
+
+ALTER TABLE borrows_returns
+    ADD COLUMN item_id BIGINT REFERENCES items(id);
+
+UPDATE borrows_returns
+SET item_id = items.id
+FROM items
+WHERE items.book_id = borrows_returns.book_id;
+
+ALTER TABLE borrows_returns
+    ALTER COLUMN item_id SET NOT NULL;
+
+DROP INDEX IF EXISTS borrows_returns_open_loan_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS borrows_returns_open_item_idx
+    ON borrows_returns (item_id) WHERE returned_at IS NULL;
+
+ALTER TABLE books
+    DROP COLUMN availability;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE books
+    ADD COLUMN availability BOOLEAN NOT NULL DEFAULT TRUE;
+
+UPDATE books
+SET availability = FALSE
+WHERE NOT EXISTS (SELECT 1 FROM items WHERE items.book_id = books.id AND items.status = 'available');
+
+DROP INDEX IF EXISTS borrows_returns_open_item_idx;
+ALTER TABLE borrows_returns
+    DROP COLUMN item_id;
+CREATE UNIQUE INDEX IF NOT EXISTS borrows_returns_open_loan_idx
+    ON borrows_returns (book_id) WHERE returned_at IS NULL;
+
+DROP TABLE items;
+-- +goose StatementEnd
@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE items
+    DROP CONSTRAINT IF EXISTS items_status_check,
+    ADD CONSTRAINT items_status_check
+        CHECK (status IN ('available', 'on_loan', 'on_hold', 'maintenance', 'lost', 'withdrawn'));
+
+ALTER TABLE holds
+    ADD COLUMN item_id BIGINT REFERENCES items(id) ON DELETE SET NULL,
+    ADD COLUMN ready_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN expires_at TIMESTAMP WITH TIME ZONE,
+    ADD CONSTRAINT holds_status_check
+        CHECK (status IN ('waiting', 'ready', 'fulfilled', 'expired', 'cancelled'));
+
+CREATE UNIQUE INDEX IF NOT EXISTS holds_active_user_book_idx
+    ON holds (book_id, user_id) WHERE status IN ('waiting', 'ready');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS holds_active_user_book_idx;
+
+ALTER TABLE holds
+    DROP CONSTRAINT IF EXISTS holds_status_check,
+    DROP COLUMN expires_at,
+    DROP COLUMN ready_at,
+    DROP COLUMN item_id;
+
+UPDATE items SET status = 'available' WHERE status = 'on_hold';
+ALTER TABLE items
+    DROP CONSTRAINT IF EXISTS items_status_check,
+    ADD CONSTRAINT items_status_check
+        CHECK (status IN ('available', 'on_loan', 'maintenance', 'lost', 'withdrawn'));
+-- +goose StatementEnd
@@ -0,0 +1,50 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE books
+    ADD COLUMN category VARCHAR(50) NOT NULL DEFAULT 'general';
+
+CREATE TABLE IF NOT EXISTS fine_rates (
+    category VARCHAR(50) PRIMARY KEY,
+    daily_rate_cents INT NOT NULL CHECK (daily_rate_cents >= 0),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO fine_rates (category, daily_rate_cents) VALUES
+    ('general', 25),
+    ('reference', 100),
+    ('childrens', 10)
+ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS fines (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    loan_id BIGINT UNIQUE NOT NULL REFERENCES borrows_returns(id) ON DELETE CASCADE,
+    days_overdue INT NOT NULL,
+    amount_cents INT NOT NULL CHECK (amount_cents >= 0),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS fines_user_idx ON fines (user_id);
+
+CREATE TABLE IF NOT EXISTS payments (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount_cents INT NOT NULL CHECK (amount_cents > 0),
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('payment', 'waiver')),
+    note TEXT NOT NULL DEFAULT '',
+    recorded_by BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS payments_user_idx ON payments (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE payments;
+DROP TABLE fines;
+DROP TABLE fine_rates;
+ALTER TABLE books
+    DROP COLUMN category;
+-- +goose StatementEnd
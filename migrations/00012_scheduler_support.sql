@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE borrows_returns
+    ADD COLUMN overdue_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS borrows_returns_open_due_idx
+    ON borrows_returns (due_at) WHERE returned_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS tokens_expiry_idx;
+DROP INDEX IF EXISTS borrows_returns_open_due_idx;
+ALTER TABLE borrows_returns
+    DROP COLUMN overdue_at;
+-- +goose StatementEnd
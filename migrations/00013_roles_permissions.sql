@@ -0,0 +1,81 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS roles (
+    name VARCHAR(50) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+    code VARCHAR(50) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role VARCHAR(50) NOT NULL REFERENCES roles(name) ON DELETE CASCADE ON UPDATE CASCADE,
+    permission VARCHAR(50) NOT NULL REFERENCES permissions(code) ON DELETE CASCADE,
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO roles (name, description) VALUES
+    ('patron', 'Library member who borrows and reserves books'),
+    ('librarian', 'Front desk staff managing the catalogue and circulation'),
+    ('branch_manager', 'Runs a branch and oversees circulation and background jobs'),
+    ('admin', 'Full access to the system')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO permissions (code, description) VALUES
+    ('books:write', 'Create, update and delete books and their copies'),
+    ('loans:override', 'Return or renew loans on behalf of other patrons'),
+    ('fines:manage', 'Record payments and waivers against fines'),
+    ('jobs:read', 'View background job status'),
+    ('users:manage', 'Manage user accounts, roles and permissions')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('librarian', 'books:write'),
+    ('librarian', 'loans:override'),
+    ('librarian', 'fines:manage'),
+    ('branch_manager', 'books:write'),
+    ('branch_manager', 'loans:override'),
+    ('branch_manager', 'fines:manage'),
+    ('branch_manager', 'jobs:read'),
+    ('admin', 'books:write'),
+    ('admin', 'loans:override'),
+    ('admin', 'fines:manage'),
+    ('admin', 'jobs:read'),
+    ('admin', 'users:manage')
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE users
+    ALTER COLUMN account_type TYPE VARCHAR(50)
+        USING (CASE account_type::TEXT WHEN 'admin' THEN 'admin' ELSE 'patron' END);
+
+UPDATE users SET account_type = 'patron' WHERE account_type IS NULL;
+
+ALTER TABLE users
+    ALTER COLUMN account_type SET DEFAULT 'patron',
+    ALTER COLUMN account_type SET NOT NULL,
+    ADD CONSTRAINT users_account_type_fkey
+        FOREIGN KEY (account_type) REFERENCES roles(name) ON UPDATE CASCADE;
+
+DROP TYPE account_type;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE TYPE account_type AS ENUM ('admin', 'user');
+
+ALTER TABLE users
+    DROP CONSTRAINT users_account_type_fkey,
+    ALTER COLUMN account_type DROP NOT NULL,
+    ALTER COLUMN account_type DROP DEFAULT;
+
+ALTER TABLE users
+    ALTER COLUMN account_type TYPE account_type
+        USING (CASE account_type WHEN 'admin' THEN 'admin' ELSE 'user' END)::account_type;
+
+DROP TABLE role_permissions;
+DROP TABLE permissions;
+DROP TABLE roles;
+-- +goose StatementEnd
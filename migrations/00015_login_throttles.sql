@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- One row per throttled subject, keyed "ip:<address>" or "user:<username>".
+-- Unknown usernames get rows too, so lockouts do not reveal which accounts
+-- exist.
+CREATE TABLE IF NOT EXISTS login_throttles (
+    key VARCHAR(320) PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS login_throttles_last_failure_idx ON login_throttles (last_failure_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE login_throttles;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- A family is every access and refresh token descended from one login.
+-- Spent refresh tokens are kept (used_at set) until they expire so that a
+-- replay can be recognised and the whole family revoked.
+ALTER TABLE tokens
+    ADD COLUMN family_id TEXT,
+    ADD COLUMN used_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family_id) WHERE family_id IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS tokens_family_idx;
+ALTER TABLE tokens
+    DROP COLUMN used_at,
+    DROP COLUMN family_id;
+-- +goose StatementEnd
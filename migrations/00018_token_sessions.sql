@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE tokens
+    ADD COLUMN created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD COLUMN last_used_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+
+-- Access tokens issued before refresh tokens existed become one-token
+-- sessions so they can be listed and revoked like the rest.
+UPDATE tokens SET family_id = md5(hash::text)
+WHERE family_id IS NULL AND scope = 'authentication';
+
+CREATE INDEX IF NOT EXISTS tokens_user_scope_idx ON tokens (user_id, scope);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS tokens_user_scope_idx;
+ALTER TABLE tokens
+    DROP COLUMN ip,
+    DROP COLUMN user_agent,
+    DROP COLUMN last_used_at,
+    DROP COLUMN created_at;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE fines ADD COLUMN IF NOT EXISTS charged_through TIMESTAMP WITH TIME ZONE;
+
+UPDATE fines
+SET charged_through = borrows_returns.due_at + make_interval(days => fines.days_overdue)
+FROM borrows_returns
+WHERE borrows_returns.id = fines.loan_id;
+
+ALTER TABLE fines ALTER COLUMN charged_through SET NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE fines DROP COLUMN IF EXISTS charged_through;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE fines
+    DROP CONSTRAINT IF EXISTS fines_loan_id_fkey,
+    ADD CONSTRAINT fines_loan_id_fkey
+        FOREIGN KEY (loan_id) REFERENCES borrows_returns(id) ON DELETE RESTRICT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE fines
+    DROP CONSTRAINT IF EXISTS fines_loan_id_fkey,
+    ADD CONSTRAINT fines_loan_id_fkey
+        FOREIGN KEY (loan_id) REFERENCES borrows_returns(id) ON DELETE CASCADE;
+-- +goose StatementEnd